@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed admin.html
+var adminHtml []byte
+
+func adminPage(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", adminHtml)
+}
+
+// adminAuth 校验管理接口的 Authorization: Bearer <ADMIN_TOKEN>
+func adminAuth(ctx *gin.Context) {
+	token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, hErr("invalid admin token"))
+		return
+	}
+	ctx.Next()
+}
+
+func registerAdminAPI(r gin.IRouter) {
+	r.GET("/pending", adminListPending)
+	r.GET("/events", adminListEvents)
+	r.GET("/groups", adminListGroups)
+	r.GET("/users/:user_id", adminUserHistory)
+	r.POST("/users/:user_id/reset", adminResetUser)
+	r.POST("/sessions/:user_id/:chat_id/approve", adminSetSessionState(userVerifySucceed))
+	r.POST("/sessions/:user_id/:chat_id/decline", adminSetSessionState(userVerifyFailed))
+}
+
+// AdminPendingSession 是一条待验证会话，Active 表示内存中有对应的会话，可以被强制通过或拒绝
+type AdminPendingSession struct {
+	UserID      int64         `json:"user_id"`
+	ChatID      int64         `json:"chat_id"`
+	Username    string        `json:"username"`
+	Source      PendingSource `json:"source,omitempty"`
+	RequestedAt time.Time     `json:"requested_at"`
+	Deadline    time.Time     `json:"deadline"`
+	Active      bool          `json:"active"`
+}
+
+// pendingSessionsSnapshot 合并内存中进行中的会话与 pending_groups 中的记录，按截止时间排序
+func pendingSessionsSnapshot() ([]AdminPendingSession, error) {
+	merged := make(map[sessionKey]AdminPendingSession)
+	if persistentStore != nil {
+		pending, err := persistentStore.ListPendingVerifications()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pending {
+			merged[sessionKey{UserId: p.UserID, ChatId: p.ChatID}] = AdminPendingSession{
+				UserID:      p.UserID,
+				ChatID:      p.ChatID,
+				Username:    p.Username,
+				Source:      p.Source,
+				RequestedAt: p.RequestedAt,
+				Deadline:    p.Deadline,
+			}
+		}
+	}
+	userStatus.Range(func(key sessionKey, e *UserJoinEvent) bool {
+		if e.State() != userVerifying {
+			return true
+		}
+		e.mu.Lock()
+		s := merged[key]
+		s.UserID, s.ChatID = key.UserId, key.ChatId
+		s.Username, s.RequestedAt, s.Deadline = e.Username, e.ReqTime, e.Deadline
+		s.Active = true
+		e.mu.Unlock()
+		merged[key] = s
+		return true
+	})
+	result := make([]AdminPendingSession, 0, len(merged))
+	for _, s := range merged {
+		result = append(result, s)
+	}
+	slices.SortFunc(result, func(a, b AdminPendingSession) int {
+		return a.Deadline.Compare(b.Deadline)
+	})
+	return result, nil
+}
+
+func adminListPending(ctx *gin.Context) {
+	sessions, err := pendingSessionsSnapshot()
+	if err != nil {
+		log.Printf("[adminListPending] 读取待验证记录失败: %v", err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, hErr(err.Error()))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"success": true, "data": sessions})
+}
+
+func pathInt64(ctx *gin.Context, name string) (int64, bool) {
+	n, err := strconv.ParseInt(ctx.Param(name), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, hErr("invalid "+name))
+		return 0, false
+	}
+	return n, true
+}
+
+// adminUserHistory 返回用户在各群组保存的验证状态、进行中的会话以及最近的验证记录，limit 参数控制记录条数
+func adminUserHistory(ctx *gin.Context) {
+	userId, ok := pathInt64(ctx, "user_id")
+	if !ok {
+		return
+	}
+	if persistentStore == nil {
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, hErr("no persistent store"))
+		return
+	}
+	limit, _ := strconv.Atoi(ctx.Query("limit"))
+	statuses, err := persistentStore.ListUserVerifications(userId)
+	if err != nil {
+		log.Printf("[adminUserHistory] 读取用户%d验证状态失败: %v", userId, err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, hErr(err.Error()))
+		return
+	}
+	events, err := persistentStore.QueryVerificationEvents(VerificationEventFilter{UserID: userId, Limit: limit})
+	if err != nil {
+		log.Printf("[adminUserHistory] 读取用户%d验证记录失败: %v", userId, err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, hErr(err.Error()))
+		return
+	}
+	sessions, err := pendingSessionsSnapshot()
+	if err != nil {
+		log.Printf("[adminUserHistory] 读取待验证记录失败: %v", err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, hErr(err.Error()))
+		return
+	}
+	sessions = slices.DeleteFunc(sessions, func(s AdminPendingSession) bool { return s.UserID != userId })
+	ctx.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{
+		"statuses": statuses,
+		"sessions": sessions,
+		"events":   events,
+	}})
+}
+
+// adminListEvents 返回最近的验证记录，可以用 user_id、chat_id、since(RFC3339) 与 limit 参数过滤
+func adminListEvents(ctx *gin.Context) {
+	if persistentStore == nil {
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, hErr("no persistent store"))
+		return
+	}
+	filter := VerificationEventFilter{}
+	var err error
+	if v := ctx.Query("user_id"); v != "" {
+		if filter.UserID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, hErr("invalid user_id"))
+			return
+		}
+	}
+	if v := ctx.Query("chat_id"); v != "" {
+		if filter.ChatID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, hErr("invalid chat_id"))
+			return
+		}
+	}
+	if v := ctx.Query("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, hErr("invalid since"))
+			return
+		}
+	}
+	filter.Limit, _ = strconv.Atoi(ctx.Query("limit"))
+	events, err := persistentStore.QueryVerificationEvents(filter)
+	if err != nil {
+		log.Printf("[adminListEvents] 读取验证记录失败: %v", err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, hErr(err.Error()))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"success": true, "data": events})
+}
+
+// AdminGroupSummary 是群组配置以及最近一段时间的验证通过率，PassRate 在没有结束的验证时为 null
+type AdminGroupSummary struct {
+	Config    GroupConfig `json:"config"`
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	PassRate  *float64    `json:"pass_rate"`
+}
+
+// adminListGroups 返回所有群组的配置与最近 days 天（默认7天）的验证通过率
+func adminListGroups(ctx *gin.Context) {
+	if persistentStore == nil {
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, hErr("no persistent store"))
+		return
+	}
+	days, err := strconv.Atoi(ctx.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, hErr("invalid days"))
+		return
+	}
+	configs, err := persistentStore.ListGroupConfigs()
+	if err != nil {
+		log.Printf("[adminListGroups] 读取群组配置失败: %v", err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, hErr(err.Error()))
+		return
+	}
+	stats, err := persistentStore.VerificationStats(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Printf("[adminListGroups] 统计验证结果失败: %v", err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, hErr(err.Error()))
+		return
+	}
+	byChat := make(map[int64]GroupVerificationStats, len(stats))
+	for _, st := range stats {
+		byChat[st.ChatID] = st
+	}
+	result := make([]AdminGroupSummary, 0, len(configs))
+	for _, gc := range configs {
+		st := byChat[gc.ChatID]
+		summary := AdminGroupSummary{Config: gc, Succeeded: st.Succeeded, Failed: st.Failed}
+		if total := st.Succeeded + st.Failed; total > 0 {
+			rate := float64(st.Succeeded) / float64(total)
+			summary.PassRate = &rate
+		}
+		result = append(result, summary)
+	}
+	ctx.JSON(http.StatusOK, gin.H{"success": true, "data": result})
+}
+
+// adminSetSessionState 强制结束一个进行中的会话，之后由会话原有的后续处理负责同意或拒绝入群
+func adminSetSessionState(state UserJoinState) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userId, ok := pathInt64(ctx, "user_id")
+		if !ok {
+			return
+		}
+		chatId, ok := pathInt64(ctx, "chat_id")
+		if !ok {
+			return
+		}
+		event, ok := userStatus.Load(sessionKey{UserId: userId, ChatId: chatId})
+		if !ok {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, hErr("session not found"))
+			return
+		}
+		if event.State() != userVerifying {
+			ctx.AbortWithStatusJSON(http.StatusConflict, hErr("session already finished"))
+			return
+		}
+		log.Printf("[adminSetSessionState] 管理员将用户%d在群组%d的验证设置为 %s", userId, chatId, statusOf(state))
+		event.SetState(state, StateChange{Trigger: TriggerAdmin, ClientIP: ctx.ClientIP()})
+		ctx.JSON(http.StatusOK, gin.H{"success": true, "data": statusOf(state)})
+	}
+}
+
+// adminResetUser 清除用户保存的验证状态与入群冷却，不影响进行中的会话
+func adminResetUser(ctx *gin.Context) {
+	userId, ok := pathInt64(ctx, "user_id")
+	if !ok {
+		return
+	}
+	if persistentStore == nil {
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, hErr("no persistent store"))
+		return
+	}
+	if err := persistentStore.ResetUserVerification(userId); err != nil {
+		log.Printf("[adminResetUser] 重置用户%d失败: %v", userId, err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, hErr(err.Error()))
+		return
+	}
+	log.Printf("[adminResetUser] 管理员重置了用户%d的验证状态", userId)
+	ctx.JSON(http.StatusOK, gin.H{"success": true})
+}
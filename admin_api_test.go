@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newAdminTestServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	oldToken, oldStore := cfg.AdminToken, persistentStore
+	cfg.AdminToken = "test-admin-token"
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() {
+		cfg.AdminToken, persistentStore = oldToken, oldStore
+	})
+	r := gin.New()
+	registerAdminAPI(r.Group("/admin/api", adminAuth))
+	return r
+}
+
+func adminRequest(r *gin.Engine, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	r := newAdminTestServer(t)
+	if w := adminRequest(r, http.MethodGet, "/admin/api/pending", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", w.Code)
+	}
+	if w := adminRequest(r, http.MethodGet, "/admin/api/pending", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with wrong token, got %d", w.Code)
+	}
+	if w := adminRequest(r, http.MethodGet, "/admin/api/pending", "test-admin-token"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with token, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAdminForceDecision(t *testing.T) {
+	r := newAdminTestServer(t)
+	key := sessionKey{UserId: 424242, ChatId: -100424242}
+	event := &UserJoinEvent{}
+	event.Init(key, "admin_test", DefaultGroupConfig(key.ChatId), TriggerJoinRequest)
+	userStatus.Store(key, event)
+	t.Cleanup(func() { userStatus.Delete(key) })
+	if err := persistentStore.AddPendingGroup(key.UserId, key.ChatId, PendingSourceJoinRequest, event.Deadline); err != nil {
+		t.Fatalf("add pending group failed: %v", err)
+	}
+
+	w := adminRequest(r, http.MethodGet, "/admin/api/pending", cfg.AdminToken)
+	var listed struct {
+		Data []AdminPendingSession `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("decode pending list failed: %v", err)
+	}
+	if len(listed.Data) != 1 || !listed.Data[0].Active || listed.Data[0].Source != PendingSourceJoinRequest {
+		t.Fatalf("unexpected pending list: %+v", listed.Data)
+	}
+
+	if w := adminRequest(r, http.MethodPost, "/admin/api/sessions/424242/-100424242/approve", cfg.AdminToken); w.Code != http.StatusOK {
+		t.Fatalf("expected approve to succeed, got %d: %s", w.Code, w.Body)
+	}
+	select {
+	case <-event.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected approve to finish the session")
+	}
+	if event.State() != userVerifySucceed {
+		t.Fatalf("expected session to succeed, got %v", event.State())
+	}
+	if w := adminRequest(r, http.MethodPost, "/admin/api/sessions/424242/-100424242/decline", cfg.AdminToken); w.Code != http.StatusConflict {
+		t.Fatalf("expected finished session to conflict, got %d", w.Code)
+	}
+	if w := adminRequest(r, http.MethodPost, "/admin/api/sessions/1/2/decline", cfg.AdminToken); w.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown session to be 404, got %d", w.Code)
+	}
+
+	events, err := persistentStore.QueryVerificationEvents(VerificationEventFilter{UserID: key.UserId})
+	if err != nil {
+		t.Fatalf("query events failed: %v", err)
+	}
+	if len(events) != 2 || events[0].Trigger != TriggerAdmin || events[0].NewStatus != StatusSuccess {
+		t.Fatalf("expected admin approval to be recorded, got %+v", events)
+	}
+
+	if err := persistentStore.SetJoinCooldown(key.UserId, key.ChatId, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("set cooldown failed: %v", err)
+	}
+	if w := adminRequest(r, http.MethodPost, "/admin/api/users/424242/reset", cfg.AdminToken); w.Code != http.StatusOK {
+		t.Fatalf("expected reset to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if uv, err := persistentStore.ListUserVerifications(key.UserId); err != nil || len(uv) != 0 {
+		t.Fatalf("expected stored status to be cleared, got %+v (err=%v)", uv, err)
+	}
+	if until, err := persistentStore.GetJoinCooldown(key.UserId, key.ChatId); err != nil || !until.IsZero() {
+		t.Fatalf("expected cooldown to be cleared, got %v (err=%v)", until, err)
+	}
+}
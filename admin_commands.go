@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// groupConfigOption 的 desc 为消息 key，show 按群组语言展示配置值，set 返回的错误为 messageError
+type groupConfigOption struct {
+	name string
+	desc string
+	show func(lang string, cfg GroupConfig) string
+	set  func(cfg *GroupConfig, value string) error
+}
+
+func durationOption(name, desc string, min, max time.Duration, field func(cfg *GroupConfig) *int) groupConfigOption {
+	return groupConfigOption{
+		name: name,
+		desc: desc,
+		show: func(lang string, cfg GroupConfig) string {
+			return formatDuration(lang, time.Duration(*field(&cfg))*time.Second)
+		},
+		set: func(cfg *GroupConfig, value string) error {
+			d, err := parseConfigDuration(value)
+			if err != nil {
+				return err
+			}
+			if d < min || d > max {
+				return newMessageError("config.err_range", "name", name, "min", min, "max", max)
+			}
+			*field(cfg) = int(d / time.Second)
+			return nil
+		},
+	}
+}
+
+func boolOption(name, desc string, field func(cfg *GroupConfig) *bool) groupConfigOption {
+	return groupConfigOption{
+		name: name,
+		desc: desc,
+		show: func(lang string, cfg GroupConfig) string {
+			if *field(&cfg) {
+				return tr(lang, "config.on")
+			}
+			return tr(lang, "config.off")
+		},
+		set: func(cfg *GroupConfig, value string) error {
+			b, err := parseConfigBool(value)
+			if err != nil {
+				return err
+			}
+			*field(cfg) = b
+			return nil
+		},
+	}
+}
+
+func enumOption(name, desc string, values []string, field func(cfg *GroupConfig) *string) groupConfigOption {
+	return groupConfigOption{
+		name: name,
+		desc: desc,
+		show: func(lang string, cfg GroupConfig) string {
+			return *field(&cfg)
+		},
+		set: func(cfg *GroupConfig, value string) error {
+			value = strings.ToLower(value)
+			if !slices.Contains(values, value) {
+				return newMessageError("config.err_enum", "name", name, "values", strings.Join(values, ", "))
+			}
+			*field(cfg) = value
+			return nil
+		},
+	}
+}
+
+// providerOption 配置群组使用的人机验证服务，default 表示跟随全局配置
+var providerOption = groupConfigOption{
+	name: "provider",
+	desc: "config.option.provider",
+	show: func(lang string, gc GroupConfig) string {
+		if gc.ChallengeProvider == "" {
+			return tr(lang, "config.default", "value", cfg.ChallengeProvider)
+		}
+		return gc.ChallengeProvider
+	},
+	set: func(gc *GroupConfig, value string) error {
+		value = strings.ToLower(value)
+		if value == "default" {
+			gc.ChallengeProvider = ""
+			return nil
+		}
+		if _, ok := challengeProviders()[value]; !ok {
+			names := make([]string, 0, len(challengeProviders()))
+			for name := range challengeProviders() {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			return newMessageError("config.err_provider", "value", value, "values", strings.Join(names, ", "))
+		}
+		gc.ChallengeProvider = value
+		return nil
+	},
+}
+
+// languageOption 配置群组消息使用的语言，default 表示跟随全局配置
+var languageOption = groupConfigOption{
+	name: "language",
+	desc: "config.option.language",
+	show: func(lang string, gc GroupConfig) string {
+		if gc.Language == "" {
+			return tr(lang, "config.default", "value", cfg.DefaultLanguage)
+		}
+		return gc.Language
+	},
+	set: func(gc *GroupConfig, value string) error {
+		if strings.ToLower(value) == "default" {
+			gc.Language = ""
+			return nil
+		}
+		lang := matchLanguage(value)
+		if lang == "" {
+			return newMessageError("config.err_language", "value", value, "values", strings.Join(availableLanguages(), ", "))
+		}
+		gc.Language = lang
+		return nil
+	},
+}
+
+// groupConfigOptions 为 /dioset 可以修改的配置项，/dioconfig 按该顺序展示
+var groupConfigOptions = []groupConfigOption{
+	durationOption("timeout", "config.option.timeout", 30*time.Second, 12*time.Hour,
+		func(cfg *GroupConfig) *int { return &cfg.VerificationTimeoutSeconds }),
+	durationOption("cooldown", "config.option.cooldown", 30*time.Second, 366*24*time.Hour,
+		func(cfg *GroupConfig) *int { return &cfg.FailureBanCooldownSeconds }),
+	boolOption("followup", "config.option.followup", func(cfg *GroupConfig) *bool { return &cfg.RequireFollowupMessage }),
+	durationOption("grace", "config.option.grace", 30*time.Second, 24*time.Hour,
+		func(cfg *GroupConfig) *int { return &cfg.KickGracePeriodSeconds }),
+	boolOption("share", "config.option.share", func(cfg *GroupConfig) *bool { return &cfg.ShareVerification }),
+	providerOption,
+	enumOption("mode", "config.option.mode", []string{verifyModeWebApp, verifyModeInline, verifyModeBoth},
+		func(cfg *GroupConfig) *string { return &cfg.VerifyMode }),
+	languageOption,
+}
+
+func findGroupConfigOption(name string) (groupConfigOption, bool) {
+	for _, opt := range groupConfigOptions {
+		if opt.name == strings.ToLower(name) {
+			return opt, true
+		}
+	}
+	return groupConfigOption{}, false
+}
+
+// parseConfigDuration 在 time.ParseDuration 的基础上支持以 d 结尾的天数
+func parseConfigDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, newMessageError("config.err_duration", "value", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, newMessageError("config.err_duration", "value", value)
+	}
+	return d, nil
+}
+
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1", "开", "开启", "是":
+		return true, nil
+	case "off", "false", "no", "0", "关", "关闭", "否":
+		return false, nil
+	}
+	return false, newMessageError("config.err_bool", "value", value)
+}
+
+func formatGroupConfig(lang string, cfg GroupConfig) string {
+	buf := strings.Builder{}
+	buf.WriteString(tr(lang, "config.title") + "\n")
+	for _, opt := range groupConfigOptions {
+		buf.WriteString(tr(lang, "config.line", "desc", tr(lang, opt.desc), "name", opt.name, "value", opt.show(lang, cfg)) + "\n")
+	}
+	buf.WriteString("\n" + tr(lang, "config.footer"))
+	return buf.String()
+}
+
+var errNotGroupAdmin = errors.New("not a group admin")
+
+// requireGroupAdmin 检查命令发送者是否为群主或拥有限制成员权限的管理员。
+// 以群组身份发言的匿名管理员同样视为管理员；不满足时不回复，避免普通成员借命令让机器人刷屏
+func requireGroupAdmin(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.SenderChat != nil && msg.SenderChat.Id == msg.Chat.Id {
+		return nil
+	}
+	if msg.From == nil {
+		return errNotGroupAdmin
+	}
+	member, err := b.GetChatMember(msg.Chat.Id, msg.From.Id, nil)
+	if err != nil {
+		return err
+	}
+	switch m := member.(type) {
+	case gotgbot.ChatMemberOwner:
+		return nil
+	case gotgbot.ChatMemberAdministrator:
+		if m.CanRestrictMembers {
+			return nil
+		}
+	}
+	return errNotGroupAdmin
+}
+
+func handleShowConfigCommand(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if !isGroupMessage(msg) {
+		return nil
+	}
+	if err := requireGroupAdmin(b, ctx); err != nil {
+		if errors.Is(err, errNotGroupAdmin) {
+			return nil
+		}
+		return err
+	}
+	groupCfg := loadGroupConfig(msg.Chat.Id)
+	_, err := msg.Reply(b, formatGroupConfig(resolveLanguage(groupCfg.Language), groupCfg), nil)
+	return err
+}
+
+func handleSetConfigCommand(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if !isGroupMessage(msg) {
+		return nil
+	}
+	if err := requireGroupAdmin(b, ctx); err != nil {
+		if errors.Is(err, errNotGroupAdmin) {
+			return nil
+		}
+		return err
+	}
+	lang := groupLanguage(msg.Chat.Id)
+	args := strings.Fields(msg.Text)[1:]
+	if len(args) != 2 {
+		names := make([]string, 0, len(groupConfigOptions))
+		for _, opt := range groupConfigOptions {
+			names = append(names, opt.name)
+		}
+		_, err := msg.Reply(b, tr(lang, "config.usage", "names", strings.Join(names, ", ")), nil)
+		return err
+	}
+	opt, ok := findGroupConfigOption(args[0])
+	if !ok {
+		_, err := msg.Reply(b, tr(lang, "config.unknown", "name", args[0]), nil)
+		return err
+	}
+	if persistentStore == nil {
+		_, err := msg.Reply(b, tr(lang, "config.no_store"), nil)
+		return err
+	}
+	cfg := loadGroupConfig(msg.Chat.Id)
+	if err := opt.set(&cfg, args[1]); err != nil {
+		_, err := msg.Reply(b, errorText(lang, err), nil)
+		return err
+	}
+	if err := persistentStore.UpsertGroupConfig(cfg); err != nil {
+		log.Printf("保存群组%d配置失败: %v", cfg.ChatID, err)
+		_, err := msg.Reply(b, tr(lang, "config.save_failed"), nil)
+		return err
+	}
+	log.Printf("用户%d将群组%d的配置 %s 修改为 %s", msg.From.Id, cfg.ChatID, opt.name, opt.show(lang, cfg))
+	// 修改语言后使用新的语言回复
+	lang = resolveLanguage(cfg.Language)
+	_, err := msg.Reply(b, tr(lang, "config.updated", "desc", tr(lang, opt.desc), "value", opt.show(lang, cfg)), nil)
+	return err
+}
+
+// cutCommandArg 返回 s 中的第一个参数与剩余内容，剩余内容保留换行，用于读取模板正文
+func cutCommandArg(s string) (string, string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+}
+
+// templatePreviewData 使用命令发送者与当前群组生成预览用的模板变量
+func templatePreviewData(b *gotgbot.Bot, msg *gotgbot.Message, lang string) templateData {
+	timeout := loadGroupConfig(msg.Chat.Id).VerificationTimeout()
+	return newTemplateData(msg.From, msg.Chat.Title).
+		withInviter(msg.From).
+		withDeadline(lang, time.Now().Add(timeout), timeout).
+		withLink("https://t.me/" + b.Username + "?startapp=preview")
+}
+
+func formatMessageTemplates(lang string, custom map[string]string) string {
+	buf := strings.Builder{}
+	buf.WriteString(tr(lang, "template.title") + "\n")
+	for _, tmpl := range messageTemplates {
+		state := tr(lang, "template.default")
+		if _, ok := custom[tmpl.name]; ok {
+			state = tr(lang, "template.custom")
+		}
+		buf.WriteString(tr(lang, "template.line", "desc", tmpl.desc(lang), "name", tmpl.name, "state", state) + "\n")
+	}
+	buf.WriteString("\n" + tr(lang, "template.footer"))
+	return buf.String()
+}
+
+// handleTemplateCommand 处理 /diotemplate：不带参数时列出全部模板，set 预览成功后保存，preview 预览当前生效的消息，reset 恢复默认
+func handleTemplateCommand(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if !isGroupMessage(msg) {
+		return nil
+	}
+	if err := requireGroupAdmin(b, ctx); err != nil {
+		if errors.Is(err, errNotGroupAdmin) {
+			return nil
+		}
+		return err
+	}
+	lang := groupLanguage(msg.Chat.Id)
+	_, rest := cutCommandArg(msg.Text)
+	action, rest := cutCommandArg(rest)
+	name, text := cutCommandArg(rest)
+	action = strings.ToLower(action)
+	if action == "" {
+		var custom map[string]string
+		if persistentStore != nil {
+			var err error
+			if custom, err = persistentStore.ListGroupTemplates(msg.Chat.Id); err != nil {
+				log.Printf("加载群组%d的消息模板失败: %v", msg.Chat.Id, err)
+			}
+		}
+		_, err := msg.Reply(b, formatMessageTemplates(lang, custom), nil)
+		return err
+	}
+	tmpl, ok := findMessageTemplate(name)
+	if name != "" && !ok {
+		_, err := msg.Reply(b, tr(lang, "template.unknown", "name", name), nil)
+		return err
+	}
+	if !ok || !slices.Contains([]string{"set", "preview", "reset"}, action) || (action == "set") != (text != "") {
+		names := make([]string, 0, len(messageTemplates))
+		for _, tmpl := range messageTemplates {
+			names = append(names, tmpl.name)
+		}
+		_, err := msg.Reply(b, tr(lang, "template.usage", "names", strings.Join(names, ", ")), nil)
+		return err
+	}
+
+	htmlOpts := &gotgbot.SendMessageOpts{ParseMode: gotgbot.ParseModeHTML}
+	if action == "preview" {
+		text := groupMessageText(msg.Chat.Id, lang, tmpl.name, templatePreviewData(b, msg, lang))
+		if _, err := msg.Reply(b, text, htmlOpts); err != nil {
+			_, err := msg.Reply(b, tr(lang, "template.err_send", "error", err.Error()), nil)
+			return err
+		}
+		return nil
+	}
+	if persistentStore == nil {
+		_, err := msg.Reply(b, tr(lang, "config.no_store"), nil)
+		return err
+	}
+	if action == "reset" {
+		if err := persistentStore.DeleteGroupTemplate(msg.Chat.Id, tmpl.name); err != nil {
+			log.Printf("删除群组%d的消息模板 %s 失败: %v", msg.Chat.Id, tmpl.name, err)
+			_, err := msg.Reply(b, tr(lang, "config.save_failed"), nil)
+			return err
+		}
+		log.Printf("用户%d将群组%d的消息模板 %s 恢复为默认", msg.From.Id, msg.Chat.Id, tmpl.name)
+		_, err := msg.Reply(b, tr(lang, "template.reset", "desc", tmpl.desc(lang)), nil)
+		return err
+	}
+
+	// 先发送预览，Telegram 无法解析其中的 HTML 时不保存
+	rendered, err := renderMessageTemplate(tmpl.name, text, templatePreviewData(b, msg, lang))
+	if err != nil {
+		_, err := msg.Reply(b, tr(lang, "template.err_parse", "error", err.Error()), nil)
+		return err
+	}
+	if _, err := msg.Reply(b, rendered, htmlOpts); err != nil {
+		_, err := msg.Reply(b, tr(lang, "template.err_send", "error", err.Error()), nil)
+		return err
+	}
+	if err := persistentStore.SetGroupTemplate(msg.Chat.Id, tmpl.name, text); err != nil {
+		log.Printf("保存群组%d的消息模板 %s 失败: %v", msg.Chat.Id, tmpl.name, err)
+		_, err := msg.Reply(b, tr(lang, "config.save_failed"), nil)
+		return err
+	}
+	log.Printf("用户%d修改了群组%d的消息模板 %s", msg.From.Id, msg.Chat.Id, tmpl.name)
+	_, err = msg.Reply(b, tr(lang, "template.saved", "desc", tmpl.desc(lang)), nil)
+	return err
+}
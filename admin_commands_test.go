@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+func TestParseConfigDuration(t *testing.T) {
+	cases := map[string]time.Duration{
+		"90s":   90 * time.Second,
+		"5m":    5 * time.Minute,
+		"1h30m": 90 * time.Minute,
+		"2d":    48 * time.Hour,
+	}
+	for input, expected := range cases {
+		d, err := parseConfigDuration(input)
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", input, err)
+		}
+		if d != expected {
+			t.Fatalf("parse %q: expected %v, got %v", input, expected, d)
+		}
+	}
+	for _, input := range []string{"", "abc", "xd", "5"} {
+		if _, err := parseConfigDuration(input); err == nil {
+			t.Fatalf("expected error parsing %q", input)
+		}
+	}
+}
+
+func TestGroupConfigOptionsSet(t *testing.T) {
+	cfg := DefaultGroupConfig(1)
+
+	timeout, ok := findGroupConfigOption("Timeout")
+	if !ok {
+		t.Fatal("expected timeout option to exist")
+	}
+	if err := timeout.set(&cfg, "5m"); err != nil {
+		t.Fatalf("set timeout failed: %v", err)
+	}
+	if cfg.VerificationTimeout() != 5*time.Minute {
+		t.Fatalf("unexpected timeout: %v", cfg.VerificationTimeout())
+	}
+	if err := timeout.set(&cfg, "1s"); err == nil {
+		t.Fatal("expected out of range timeout to be rejected")
+	}
+	if cfg.VerificationTimeout() != 5*time.Minute {
+		t.Fatalf("rejected value must not modify config, got %v", cfg.VerificationTimeout())
+	}
+
+	followup, _ := findGroupConfigOption("followup")
+	if err := followup.set(&cfg, "on"); err != nil || !cfg.RequireFollowupMessage {
+		t.Fatalf("expected followup to be enabled, err=%v", err)
+	}
+	if err := followup.set(&cfg, "maybe"); err == nil {
+		t.Fatal("expected invalid bool to be rejected")
+	}
+
+	if _, ok := findGroupConfigOption("unknown"); ok {
+		t.Fatal("expected unknown option to be missing")
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	cases := map[time.Duration]string{
+		0:                            "0秒",
+		45 * time.Second:             "45秒",
+		10 * time.Minute:             "10分钟",
+		90 * time.Minute:             "1小时30分钟",
+		26*time.Hour + 5*time.Second: "1天2小时5秒",
+	}
+	for d, expected := range cases {
+		if got := formatDuration("zh-CN", d); got != expected {
+			t.Fatalf("formatDuration(%v): expected %q, got %q", d, expected, got)
+		}
+	}
+}
+
+func TestFormatDurationEnglish(t *testing.T) {
+	if got := formatDuration("en", 26*time.Hour+5*time.Second); got != "1d 2h 5s" {
+		t.Fatalf("unexpected english duration: %q", got)
+	}
+}
+
+func TestGroupConfigOptionErrorsAreLocalized(t *testing.T) {
+	cfg := DefaultGroupConfig(1)
+	timeout, _ := findGroupConfigOption("timeout")
+	err := timeout.set(&cfg, "1s")
+	if got := errorText("en", err); got != "timeout must be between 30s and 12h" {
+		t.Fatalf("unexpected english error: %q", got)
+	}
+	if got := errorText("zh-CN", err); got != "timeout 需要在 30秒 到 12小时 之间" {
+		t.Fatalf("unexpected chinese error: %q", got)
+	}
+
+	language, _ := findGroupConfigOption("language")
+	if err := language.set(&cfg, "EN-us"); err != nil || cfg.Language != "en" {
+		t.Fatalf("expected language to resolve to en, got %q (err=%v)", cfg.Language, err)
+	}
+	if err := language.set(&cfg, "xx"); err == nil {
+		t.Fatal("expected unknown language to be rejected")
+	}
+	if err := language.set(&cfg, "default"); err != nil || cfg.Language != "" {
+		t.Fatalf("expected default to clear the language, got %q", cfg.Language)
+	}
+}
+
+func TestRequireGroupAdminAnonymous(t *testing.T) {
+	chat := gotgbot.Chat{Id: -100777, Type: "supergroup"}
+	// 匿名管理员以群组身份发言，不需要查询成员信息
+	anonymous := &ext.Context{EffectiveMessage: &gotgbot.Message{Chat: chat, SenderChat: &chat}}
+	if err := requireGroupAdmin(nil, anonymous); err != nil {
+		t.Fatalf("expected anonymous admin to be accepted, got %v", err)
+	}
+	channel := &ext.Context{EffectiveMessage: &gotgbot.Message{Chat: chat, SenderChat: &gotgbot.Chat{Id: -100888, Type: "channel"}}}
+	if err := requireGroupAdmin(nil, channel); !errors.Is(err, errNotGroupAdmin) {
+		t.Fatalf("expected other sender chats to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinCaptchaVerify(t *testing.T) {
+	c := newBuiltinCaptcha()
+	id, img, err := c.New()
+	if err != nil {
+		t.Fatalf("new captcha failed: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(img)); err != nil {
+		t.Fatalf("captcha is not a valid png: %v", err)
+	}
+	entry, ok := c.entries.Load(id)
+	if !ok {
+		t.Fatal("expected captcha answer to be stored")
+	}
+
+	result, err := c.Verify(context.Background(), id+":"+entry.answer, "")
+	if err != nil || !result.Success {
+		t.Fatalf("expected correct answer to pass, got %+v (err=%v)", result, err)
+	}
+	result, _ = c.Verify(context.Background(), id+":"+entry.answer, "")
+	if result.Success {
+		t.Fatal("expected captcha to be single use")
+	}
+
+	id, _, _ = c.New()
+	result, _ = c.Verify(context.Background(), id+":wrong", "")
+	if result.Success || result.ErrorCodes[0] != "incorrect-answer" {
+		t.Fatalf("expected wrong answer to fail, got %+v", result)
+	}
+}
+
+func TestRenderCaptchaRejectsUnknownGlyph(t *testing.T) {
+	if _, err := renderCaptcha("1+a"); err == nil || !strings.Contains(err.Error(), "glyph") {
+		t.Fatalf("expected missing glyph error, got %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChallengePage 是验证页面渲染人机验证组件所需的参数，会原样发送给前端
+type ChallengePage struct {
+	Provider string `json:"provider"`
+	// ScriptURL 为组件的js地址，页面会在其后追加 onload 回调参数
+	ScriptURL string `json:"script_url,omitempty"`
+	SiteKey   string `json:"site_key,omitempty"`
+	// Action 与 Cdata 只有 Turnstile 支持，会原样出现在校验结果中，用于将 token 绑定到本服务与当前用户
+	Action string `json:"action,omitempty"`
+	Cdata  string `json:"cdata,omitempty"`
+}
+
+// ChallengeResult 是服务端校验人机验证token的结果
+type ChallengeResult struct {
+	Success     bool
+	ErrorCodes  []string
+	Hostname    string
+	Action      string
+	Cdata       string
+	ChallengeTs time.Time
+}
+
+// ChallengeProvider 表示一种人机验证服务，页面参数由 Page 提供，token 由 Verify 在服务端校验。
+// Verify 只在无法得到校验结果时返回 error，token 无效时应返回 Success 为 false 的结果。
+type ChallengeProvider interface {
+	Name() string
+	Page(userId int64) ChallengePage
+	Verify(ctx context.Context, token, remoteIP string) (ChallengeResult, error)
+}
+
+// siteVerifyResp 为 Turnstile、hCaptcha、reCAPTCHA 三者 siteverify 接口响应的公共部分
+type siteVerifyResp struct {
+	Success     bool     `json:"success"`
+	ChallengeTs string   `json:"challenge_ts,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+	ErrorCodes  []string `json:"error-codes,omitempty"`
+	Action      string   `json:"action,omitempty"`
+	Cdata       string   `json:"cdata,omitempty"`
+}
+
+// siteVerifyProvider 适用于以表单提交 secret、response、remoteip 到 siteverify 接口的验证服务。
+// 只有支持 idempotency_key 的服务（Turnstile）会在网络错误或5xx时重试，
+// 其他服务重试同一个 token 可能因为 token 已被消耗而被判定为失败。
+type siteVerifyProvider struct {
+	name      string
+	scriptURL string
+	verifyURL string
+	siteKey   string
+	secret    string
+	client    *http.Client
+	// idempotent 为真时每次校验附带 idempotency_key，重试不会重复消耗 token
+	idempotent bool
+	retries    int
+	// bindUser 为真时页面参数带有 action 与用户对应的 cdata
+	bindUser bool
+}
+
+// siteVerifyRetryBase 为第一次重试前的等待时间，之后每次翻倍
+const siteVerifyRetryBase = 200 * time.Millisecond
+
+// errSiteVerifyRetryable 表示本次请求失败但可以重试
+type errSiteVerifyRetryable struct {
+	err error
+}
+
+func (e errSiteVerifyRetryable) Error() string { return e.err.Error() }
+func (e errSiteVerifyRetryable) Unwrap() error { return e.err }
+
+func (p *siteVerifyProvider) Name() string {
+	return p.name
+}
+
+func (p *siteVerifyProvider) Page(userId int64) ChallengePage {
+	page := ChallengePage{Provider: p.name, ScriptURL: p.scriptURL, SiteKey: p.siteKey}
+	if p.bindUser {
+		page.Action = challengeAction
+		page.Cdata = challengeCdata(userId)
+	}
+	return page
+}
+
+func (p *siteVerifyProvider) Verify(ctx context.Context, token, remoteIP string) (ChallengeResult, error) {
+	form := make(url.Values)
+	form.Set("secret", p.secret)
+	form.Set("response", token)
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	retries := 0
+	if p.idempotent {
+		form.Set("idempotency_key", newUUID())
+		retries = p.retries
+	}
+	body := form.Encode()
+	for attempt := 0; ; attempt++ {
+		data, err := p.siteVerify(ctx, body)
+		if err == nil {
+			return data.result(), nil
+		}
+		var retryable errSiteVerifyRetryable
+		if !errors.As(err, &retryable) || attempt >= retries {
+			return ChallengeResult{}, err
+		}
+		log.Printf("请求 %s siteverify 失败，第%d次重试: %v", p.name, attempt+1, err)
+		select {
+		case <-time.After(siteVerifyRetryBase << attempt):
+		case <-ctx.Done():
+			return ChallengeResult{}, ctx.Err()
+		}
+	}
+}
+
+// siteVerify 请求一次 siteverify 接口，网络错误与5xx响应返回 errSiteVerifyRetryable
+func (p *siteVerifyProvider) siteVerify(ctx context.Context, body string) (siteVerifyResp, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.verifyURL, strings.NewReader(body))
+	if err != nil {
+		return siteVerifyResp{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	metricSiteVerifyLatency.WithLabelValues(p.name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		err = fmt.Errorf("request %s siteverify: %w", p.name, err)
+		if ctx.Err() != nil {
+			return siteVerifyResp{}, err
+		}
+		return siteVerifyResp{}, errSiteVerifyRetryable{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return siteVerifyResp{}, errSiteVerifyRetryable{fmt.Errorf("%s siteverify returned %s", p.name, resp.Status)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return siteVerifyResp{}, fmt.Errorf("%s siteverify returned %s", p.name, resp.Status)
+	}
+	var data siteVerifyResp
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&data); err != nil {
+		return siteVerifyResp{}, fmt.Errorf("decode %s siteverify response: %w", p.name, err)
+	}
+	return data, nil
+}
+
+func (data siteVerifyResp) result() ChallengeResult {
+	result := ChallengeResult{
+		Success:    data.Success,
+		ErrorCodes: data.ErrorCodes,
+		Hostname:   data.Hostname,
+		Action:     data.Action,
+		Cdata:      data.Cdata,
+	}
+	if data.ChallengeTs != "" {
+		// 各家返回的时间格式略有差异，解析失败时保留零值
+		if ts, err := time.Parse(time.RFC3339, data.ChallengeTs); err == nil {
+			result.ChallengeTs = ts
+		}
+	}
+	return result
+}
+
+// challengeAction 为页面渲染 Turnstile 时使用的 action，同一 sitekey 下其他站点或用途的 token 会被拒绝
+const challengeAction = "dio_verify"
+
+var challengeBindingKey = sync.OnceValue(func() []byte {
+	mac := hmac.New(sha256.New, []byte("ChallengeBinding"))
+	mac.Write([]byte(cfg.BotToken))
+	return mac.Sum(nil)
+})
+
+// challengeCdata 返回与用户绑定的 cdata，只包含 Turnstile 允许的字符且不超过其长度限制
+func challengeCdata(userId int64) string {
+	mac := hmac.New(sha256.New, challengeBindingKey())
+	mac.Write([]byte(strconv.FormatInt(userId, 10)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// checkChallengeResult 将校验结果与发给页面的参数比对，返回不符合的项对应的错误码。
+// 只检查页面参数中存在的项，主机名只在配置了白名单且服务返回了主机名时检查。
+func checkChallengeResult(page ChallengePage, result ChallengeResult, now time.Time) []string {
+	var codes []string
+	if len(cfg.ChallengeHostnames) > 0 && page.Provider != providerBuiltin && !slices.Contains(cfg.ChallengeHostnames, result.Hostname) {
+		codes = append(codes, "hostname-mismatch")
+	}
+	if page.Action != "" && result.Action != page.Action {
+		codes = append(codes, "action-mismatch")
+	}
+	if page.Cdata != "" && !hmac.Equal([]byte(result.Cdata), []byte(page.Cdata)) {
+		codes = append(codes, "cdata-mismatch")
+	}
+	if !result.ChallengeTs.IsZero() && now.Sub(result.ChallengeTs) > cfg.ChallengeMaxAge {
+		codes = append(codes, "challenge-expired")
+	}
+	return codes
+}
+
+// newUUID 生成 Turnstile idempotency_key 要求的 UUID v4
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// siteVerifyClient 为每次请求 siteverify 设置超时，重试时每次请求单独计时
+func siteVerifyClient() *http.Client {
+	return &http.Client{Timeout: cfg.SiteVerifyTimeout}
+}
+
+const (
+	providerTurnstile = "turnstile"
+	providerHCaptcha  = "hcaptcha"
+	providerReCaptcha = "recaptcha"
+)
+
+// challengeProviders 返回所有可用的验证服务，内置验证码与 Turnstile 总是可用（后者未配置时使用测试key）
+var challengeProviders = sync.OnceValue(func() map[string]ChallengeProvider {
+	providers := map[string]ChallengeProvider{
+		providerBuiltin: builtinCaptchas,
+		providerTurnstile: &siteVerifyProvider{
+			name:       providerTurnstile,
+			scriptURL:  "https://challenges.cloudflare.com/turnstile/v0/api.js?render=explicit",
+			verifyURL:  cfg.TurnstileVerifyURL,
+			siteKey:    cfg.TurnstileSiteKey,
+			secret:     cfg.TurnstileSecret,
+			client:     siteVerifyClient(),
+			idempotent: true,
+			retries:    cfg.SiteVerifyRetries,
+			bindUser:   true,
+		},
+	}
+	if cfg.HCaptchaSiteKey != "" && cfg.HCaptchaSecret != "" {
+		providers[providerHCaptcha] = &siteVerifyProvider{
+			name:      providerHCaptcha,
+			scriptURL: "https://js.hcaptcha.com/1/api.js?render=explicit",
+			verifyURL: cfg.HCaptchaVerifyURL,
+			siteKey:   cfg.HCaptchaSiteKey,
+			secret:    cfg.HCaptchaSecret,
+			client:    siteVerifyClient(),
+		}
+	}
+	if cfg.ReCaptchaSiteKey != "" && cfg.ReCaptchaSecret != "" {
+		providers[providerReCaptcha] = &siteVerifyProvider{
+			name:      providerReCaptcha,
+			scriptURL: "https://www.google.com/recaptcha/api.js?render=explicit",
+			verifyURL: cfg.ReCaptchaVerifyURL,
+			siteKey:   cfg.ReCaptchaSiteKey,
+			secret:    cfg.ReCaptchaSecret,
+			client:    siteVerifyClient(),
+		}
+	}
+	return providers
+})
+
+// challengeProviderFor 返回群组使用的验证服务，群组未指定或指定的服务未配置时使用全局默认值
+func challengeProviderFor(chatId int64) ChallengeProvider {
+	providers := challengeProviders()
+	name := loadGroupConfig(chatId).ChallengeProvider
+	if name != "" {
+		if p, ok := providers[name]; ok {
+			return p
+		}
+		log.Printf("群组%d配置的验证服务 %s 不可用，使用默认的 %s", chatId, name, cfg.ChallengeProvider)
+	}
+	return providers[cfg.ChallengeProvider]
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSiteVerifyProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse form failed: %v", err)
+		}
+		if r.PostForm.Get("secret") != "secret" || r.PostForm.Get("remoteip") != "1.2.3.4" {
+			t.Errorf("unexpected form: %v", r.PostForm)
+		}
+		resp := siteVerifyResp{Success: r.PostForm.Get("response") == "good", Hostname: "example.com"}
+		if resp.Success {
+			resp.ChallengeTs = "2024-01-02T03:04:05.678Z"
+		} else {
+			resp.ErrorCodes = []string{"invalid-input-response"}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	p := &siteVerifyProvider{name: "test", verifyURL: srv.URL, siteKey: "site", secret: "secret", client: srv.Client()}
+	if page := p.Page(1); page.Provider != "test" || page.SiteKey != "site" {
+		t.Fatalf("unexpected page params: %+v", page)
+	}
+
+	result, err := p.Verify(context.Background(), "good", "1.2.3.4")
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if !result.Success || result.Hostname != "example.com" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if !result.ChallengeTs.Equal(time.Date(2024, 1, 2, 3, 4, 5, 678000000, time.UTC)) {
+		t.Fatalf("unexpected challenge ts: %v", result.ChallengeTs)
+	}
+
+	result, err = p.Verify(context.Background(), "bad", "1.2.3.4")
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if result.Success || len(result.ErrorCodes) != 1 {
+		t.Fatalf("expected failure with error codes, got %+v", result)
+	}
+}
+
+func TestSiteVerifyProviderBadResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("not json"))
+	}))
+	defer srv.Close()
+
+	p := &siteVerifyProvider{name: "test", verifyURL: srv.URL, client: srv.Client()}
+	if _, err := p.Verify(context.Background(), "token", ""); err == nil {
+		t.Fatal("expected decode error")
+	}
+}
+
+func TestSiteVerifyProviderRetries(t *testing.T) {
+	var attempts atomic.Int32
+	keys := make(chan string, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		keys <- r.PostForm.Get("idempotency_key")
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(siteVerifyResp{Success: true})
+	}))
+	defer srv.Close()
+
+	p := &siteVerifyProvider{name: "test", verifyURL: srv.URL, client: srv.Client(), idempotent: true, retries: 2}
+	result, err := p.Verify(context.Background(), "token", "")
+	if err != nil || !result.Success {
+		t.Fatalf("expected success after retries, got %+v (err=%v)", result, err)
+	}
+	first := <-keys
+	if len(first) != 36 || <-keys != first || <-keys != first {
+		t.Fatalf("expected the same idempotency key on every attempt, got %q", first)
+	}
+
+	attempts.Store(0)
+	p.retries = 1
+	if _, err := p.Verify(context.Background(), "token", ""); err == nil {
+		t.Fatal("expected error when retries are exhausted")
+	}
+	if attempts.Load() != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts.Load())
+	}
+	<-keys
+	<-keys
+}
+
+func TestSiteVerifyProviderStatusCodes(t *testing.T) {
+	var attempts, status atomic.Int32
+	status.Store(http.StatusBadRequest)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer srv.Close()
+
+	// 4xx 不会重试
+	p := &siteVerifyProvider{name: "test", verifyURL: srv.URL, client: srv.Client(), idempotent: true, retries: 2}
+	if _, err := p.Verify(context.Background(), "token", ""); err == nil || attempts.Load() != 1 {
+		t.Fatalf("expected a single failed attempt on 4xx, got %d (err=%v)", attempts.Load(), err)
+	}
+
+	// 不支持 idempotency_key 的服务不会重试
+	attempts.Store(0)
+	status.Store(http.StatusServiceUnavailable)
+	p.idempotent = false
+	if _, err := p.Verify(context.Background(), "token", ""); err == nil || attempts.Load() != 1 {
+		t.Fatalf("expected a single attempt without idempotency, got %d (err=%v)", attempts.Load(), err)
+	}
+}
+
+func TestCheckChallengeResult(t *testing.T) {
+	oldHostnames, oldMaxAge := cfg.ChallengeHostnames, cfg.ChallengeMaxAge
+	cfg.ChallengeHostnames, cfg.ChallengeMaxAge = []string{"dio.example.com"}, 5*time.Minute
+	t.Cleanup(func() { cfg.ChallengeHostnames, cfg.ChallengeMaxAge = oldHostnames, oldMaxAge })
+
+	p := &siteVerifyProvider{name: providerTurnstile, bindUser: true}
+	page := p.Page(42)
+	if page.Action != challengeAction || len(page.Cdata) != 32 || page.Cdata == p.Page(43).Cdata {
+		t.Fatalf("expected per-user cdata and action, got %+v", page)
+	}
+
+	now := time.Now()
+	valid := ChallengeResult{Success: true, Hostname: "dio.example.com", Action: page.Action, Cdata: page.Cdata, ChallengeTs: now.Add(-time.Minute)}
+	if codes := checkChallengeResult(page, valid, now); len(codes) != 0 {
+		t.Fatalf("expected valid result, got %v", codes)
+	}
+
+	cases := map[string]func(r *ChallengeResult){
+		"hostname-mismatch": func(r *ChallengeResult) { r.Hostname = "evil.example.com" },
+		"action-mismatch":   func(r *ChallengeResult) { r.Action = "login" },
+		"cdata-mismatch":    func(r *ChallengeResult) { r.Cdata = p.Page(43).Cdata },
+		"challenge-expired": func(r *ChallengeResult) { r.ChallengeTs = now.Add(-10 * time.Minute) },
+	}
+	for code, mutate := range cases {
+		r := valid
+		mutate(&r)
+		if codes := checkChallengeResult(page, r, now); len(codes) != 1 || codes[0] != code {
+			t.Fatalf("expected %s, got %v", code, codes)
+		}
+	}
+
+	// 内置验证码没有主机名、action 与 cdata
+	builtinPage := builtinCaptchas.Page(42)
+	if codes := checkChallengeResult(builtinPage, ChallengeResult{Success: true, ChallengeTs: now}, now); len(codes) != 0 {
+		t.Fatalf("expected builtin result to pass, got %v", codes)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// getUpdates 长轮询超时为9秒，超过 pollStaleAfter 没有成功说明轮询已经停止或一直失败
+	pollStaleAfter     = time.Minute
+	readinessTimeout   = 5 * time.Second
+	readinessCheckOK   = "ok"
+	readinessCheckFail = "fail"
+)
+
+// lastGetUpdatesSuccess 为最近一次 getUpdates 成功的时间（UnixNano），由 instrumentedBotClient 更新
+var lastGetUpdatesSuccess atomic.Int64
+
+type readinessCheck struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func healthz(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"status": readinessCheckOK})
+}
+
+// readyz 检查数据库、接收更新与 Bot API，任意一项失败时返回503
+func readyz(b *gotgbot.Bot) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		c, cancel := context.WithTimeout(ctx.Request.Context(), readinessTimeout)
+		defer cancel()
+		checks := map[string]readinessCheck{
+			"database": readinessResult(persistentStore.Ping(c)),
+			"updates":  readinessResult(checkUpdates(c, b)),
+			"telegram": readinessResult(checkGetMe(c, b)),
+		}
+		status, code := readinessCheckOK, http.StatusOK
+		for _, check := range checks {
+			if check.Status != readinessCheckOK {
+				status, code = readinessCheckFail, http.StatusServiceUnavailable
+			}
+		}
+		ctx.JSON(code, gin.H{"status": status, "checks": checks})
+	}
+}
+
+func readinessResult(err error) readinessCheck {
+	if err != nil {
+		return readinessCheck{Status: readinessCheckFail, Detail: err.Error()}
+	}
+	return readinessCheck{Status: readinessCheckOK}
+}
+
+// checkUpdates 在长轮询模式下检查最近一次 getUpdates 是否成功，webhook 模式下检查 Telegram 记录的 webhook 地址
+func checkUpdates(ctx context.Context, b *gotgbot.Bot) error {
+	if cfg.WebhookURL != "" {
+		info, err := b.GetWebhookInfoWithContext(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if expected := strings.TrimSuffix(cfg.WebhookURL, "/") + "/" + webhookPath; info.Url != expected {
+			return fmt.Errorf("webhook url is %q, expected %q", info.Url, expected)
+		}
+		return nil
+	}
+	last := lastGetUpdatesSuccess.Load()
+	if last == 0 {
+		return fmt.Errorf("no successful getUpdates yet")
+	}
+	if since := time.Since(time.Unix(0, last)); since > pollStaleAfter {
+		return fmt.Errorf("last successful getUpdates was %s ago", since.Round(time.Second))
+	}
+	return nil
+}
+
+func checkGetMe(ctx context.Context, b *gotgbot.Bot) error {
+	_, err := b.GetMeWithContext(ctx, nil)
+	return err
+}
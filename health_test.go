@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/gin-gonic/gin"
+)
+
+type getMeBotClient struct {
+	gotgbot.BaseBotClient
+}
+
+func (c *getMeBotClient) RequestWithContext(_ context.Context, _ string, method string, _ map[string]string, _ map[string]gotgbot.FileReader, _ *gotgbot.RequestOpts) (json.RawMessage, error) {
+	if method == "getUpdates" {
+		return json.RawMessage(`[]`), nil
+	}
+	return json.RawMessage(`{"id":1,"is_bot":true,"first_name":"dio"}`), nil
+}
+
+func TestReadyz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldStore, oldLast := persistentStore, lastGetUpdatesSuccess.Load()
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() {
+		persistentStore = oldStore
+		lastGetUpdatesSuccess.Store(oldLast)
+	})
+	client := &instrumentedBotClient{BotClient: &getMeBotClient{}}
+	b := &gotgbot.Bot{Token: "1:test", BotClient: client}
+	r := gin.New()
+	r.GET("/readyz", readyz(b))
+	probe := func() (int, map[string]readinessCheck) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var body struct {
+			Checks map[string]readinessCheck `json:"checks"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode readyz response failed: %v", err)
+		}
+		return w.Code, body.Checks
+	}
+
+	lastGetUpdatesSuccess.Store(0)
+	if code, checks := probe(); code != http.StatusServiceUnavailable || checks["updates"].Status != readinessCheckFail {
+		t.Fatalf("expected not ready before polling, got %d %+v", code, checks)
+	}
+
+	if _, err := client.RequestWithContext(context.Background(), b.Token, "getUpdates", nil, nil, nil); err != nil {
+		t.Fatalf("getUpdates failed: %v", err)
+	}
+	if code, checks := probe(); code != http.StatusOK {
+		t.Fatalf("expected ready after getUpdates, got %d %+v", code, checks)
+	}
+
+	lastGetUpdatesSuccess.Store(time.Now().Add(-2 * pollStaleAfter).UnixNano())
+	if code, checks := probe(); code != http.StatusServiceUnavailable || checks["database"].Status != readinessCheckOK {
+		t.Fatalf("expected stale polling to be not ready, got %d %+v", code, checks)
+	}
+}
@@ -1,21 +1,25 @@
 package main
 
 import (
-	"bytes"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	_ "embed"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"net/http"
 	"net/url"
 	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -23,90 +27,198 @@ func hErr(str string) gin.H {
 	return gin.H{"error": str, "success": false}
 }
 
-var botVerifyKey = sync.OnceValue(func() []byte {
-	mac := hmac.New(sha256.New, []byte("WebAppData"))
-	mac.Write([]byte(cfg.BotToken))
-	return mac.Sum(nil)
-})
-
 //go:embed index.html
 var mainHtml []byte
 
+// WebInitUser 对应 Mini App initData 中的 WebAppUser
 type WebInitUser struct {
-	Id              int64  `json:"id"`
-	FirstName       string `json:"first_name"`
-	LastName        string `json:"last_name"`
-	Username        string `json:"username"`
-	LanguageCode    string `json:"language_code"`
-	IsPremium       bool   `json:"is_premium"`
-	AllowsWriteToPm bool   `json:"allows_write_to_pm"`
+	Id                    int64  `json:"id"`
+	IsBot                 bool   `json:"is_bot"`
+	FirstName             string `json:"first_name"`
+	LastName              string `json:"last_name"`
+	Username              string `json:"username"`
+	LanguageCode          string `json:"language_code"`
+	IsPremium             bool   `json:"is_premium"`
+	AddedToAttachmentMenu bool   `json:"added_to_attachment_menu"`
+	AllowsWriteToPm       bool   `json:"allows_write_to_pm"`
+	PhotoUrl              string `json:"photo_url"`
+}
+
+// WebInitChat 对应 initData 中的 WebAppChat，只有从附件菜单打开时才会有
+type WebInitChat struct {
+	Id       int64  `json:"id"`
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Username string `json:"username"`
+	PhotoUrl string `json:"photo_url"`
 }
 
+// AuthInfo 为校验通过的 initData，Receiver 与 Chat 只在特定的打开方式下存在
 type AuthInfo struct {
-	QueryId  string      `json:"query_id"`
-	User     WebInitUser `json:"user"`
-	AuthDate time.Time   `json:"auth_date"`
-	Hash     string      `json:"hash"`
+	QueryId  string       `json:"query_id"`
+	User     WebInitUser  `json:"user"`
+	Receiver *WebInitUser `json:"receiver,omitempty"`
+	Chat     *WebInitChat `json:"chat,omitempty"`
+	// ChatType 为打开 Mini App 的聊天类型，例如 sender、private、group、supergroup、channel
+	ChatType     string `json:"chat_type"`
+	ChatInstance string `json:"chat_instance"`
+	// StartParam 为链接中 startapp 参数的值
+	StartParam string `json:"start_param"`
+	// CanSendAfter 为多久之后可以通过 answerWebAppQuery 发送消息
+	CanSendAfter time.Duration `json:"can_send_after"`
+	AuthDate     time.Time     `json:"auth_date"`
+	Hash         string        `json:"hash"`
+	// Signature 为 Telegram 的 Ed25519 签名，供不持有 bot token 的第三方校验
+	Signature string `json:"signature"`
 }
 
-func checkTelegramAuth(str string, verifyKey []byte) (res AuthInfo, err error) {
+// setField 解析 initData 中的一个字段，未知的字段会被忽略
+func (a *AuthInfo) setField(key, value string) error {
+	switch key {
+	case "query_id":
+		a.QueryId = value
+	case "user":
+		return json.Unmarshal([]byte(value), &a.User)
+	case "receiver":
+		a.Receiver = &WebInitUser{}
+		return json.Unmarshal([]byte(value), a.Receiver)
+	case "chat":
+		a.Chat = &WebInitChat{}
+		return json.Unmarshal([]byte(value), a.Chat)
+	case "chat_type":
+		a.ChatType = value
+	case "chat_instance":
+		a.ChatInstance = value
+	case "start_param":
+		a.StartParam = value
+	case "can_send_after":
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		a.CanSendAfter = time.Duration(seconds) * time.Second
+	case "auth_date":
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		a.AuthDate = time.Unix(seconds, 0)
+	case "hash":
+		a.Hash = value
+	case "signature":
+		a.Signature = value
+	}
+	return nil
+}
+
+// initDataVerifier 校验 Mini App 的 initData，hmacKey 与 publicKey 都为空时拒绝所有 initData。
+// 只配置 Telegram 公钥时不需要 bot token，可以用于单独的校验服务。
+type initDataVerifier struct {
+	hmacKey   []byte            // 由 bot token 派生，用于校验 hash
+	botId     int64             // 校验 signature 时需要
+	publicKey ed25519.PublicKey // Telegram 公钥，用于校验 signature
+}
+
+var initDataAuth initDataVerifier
+
+// newInitDataVerifier 根据配置创建校验器，botId 为0时从 bot token 中取得
+func newInitDataVerifier(botToken, publicKeyHex string, botId int64) (v initDataVerifier, err error) {
+	if botToken != "" {
+		mac := hmac.New(sha256.New, []byte("WebAppData"))
+		mac.Write([]byte(botToken))
+		v.hmacKey = mac.Sum(nil)
+		if botId == 0 {
+			idStr, _, _ := strings.Cut(botToken, ":")
+			botId, _ = strconv.ParseInt(idStr, 10, 64)
+		}
+	}
+	if publicKeyHex != "" {
+		key, err := hex.DecodeString(publicKeyHex)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return v, fmt.Errorf("invalid ed25519 public key %q", publicKeyHex)
+		}
+		if botId == 0 {
+			return v, errors.New("bot id is required to check initData signature")
+		}
+		v.publicKey, v.botId = key, botId
+	}
+	return v, nil
+}
+
+// checkTelegramAuth 校验 initData 并解析其中的字段。配置了公钥且 initData 带有 signature 时校验
+// Ed25519 签名，否则使用 bot token 校验 hash。
+func checkTelegramAuth(str string, v initDataVerifier) (res AuthInfo, err error) {
 	split := strings.Split(str, "&")
-	const hashPrefix = "hash"
-	recvHash := ""
+	recvHash, recvSig := "", ""
 	data := make([]string, 0, len(split))
-	for _, v := range split {
-		key, value, _ := strings.Cut(v, "=")
-		if key == hashPrefix {
-			recvHash = value
-			continue
-		}
+	for _, kv := range split {
+		key, value, _ := strings.Cut(kv, "=")
 		key, err1 := url.QueryUnescape(key)
 		value, err2 := url.QueryUnescape(value)
 		if err1 != nil || err2 != nil {
 			err = fmt.Errorf("url unescape err %v %v", err1, err2)
 			return
 		}
+		switch key {
+		case "hash":
+			recvHash = value
+			continue
+		case "signature":
+			recvSig = value
+		}
 		data = append(data, key+"="+value)
 	}
-	if recvHash == "" {
-		err = fmt.Errorf("no hash")
-		return
-	}
-
 	slices.Sort(data)
-	initData := []byte(strings.Join(data, "\n"))
-	mac := hmac.New(sha256.New, verifyKey)
-	mac.Write(initData)
-	calcHash := hex.EncodeToString(mac.Sum(nil))
-	if recvHash != calcHash {
-		log.Printf("[checkTelegramAuth] 校验失败: calc=%s..., recv=%s...", calcHash[:6], recvHash[:6])
-		err = fmt.Errorf("wrong recvHash calc=%s*** recv=%s", calcHash[:4], recvHash)
+
+	switch {
+	case v.publicKey != nil && recvSig != "":
+		sig, decodeErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(recvSig, "="))
+		if decodeErr != nil {
+			err = fmt.Errorf("decode signature: %w", decodeErr)
+			return
+		}
+		// signature 本身不参与签名
+		signed := slices.DeleteFunc(slices.Clone(data), func(s string) bool { return strings.HasPrefix(s, "signature=") })
+		initData := fmt.Sprintf("%d:WebAppData\n%s", v.botId, strings.Join(signed, "\n"))
+		if !ed25519.Verify(v.publicKey, []byte(initData), sig) {
+			log.Printf("[checkTelegramAuth] 签名校验失败")
+			err = errors.New("wrong signature")
+			return
+		}
+	case v.hmacKey != nil && recvHash != "":
+		mac := hmac.New(sha256.New, v.hmacKey)
+		mac.Write([]byte(strings.Join(data, "\n")))
+		calcHash := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(recvHash), []byte(calcHash)) {
+			log.Printf("[checkTelegramAuth] 校验失败: calc=%s..., recv=%.6s...", calcHash[:6], recvHash)
+			err = fmt.Errorf("wrong recvHash calc=%s*** recv=%s", calcHash[:4], recvHash)
+			return
+		}
+	default:
+		err = fmt.Errorf("no hash")
 		return
 	}
-	for _, v := range data {
-		key, value, _ := strings.Cut(v, "=")
-		switch key {
-		case "auth_date":
-			parseInt, err := strconv.ParseInt(value, 10, 64)
-			if err != nil {
-				return AuthInfo{}, err
-			}
-			res.AuthDate = time.Unix(parseInt, 0)
-		case "hash":
-			res.Hash = value
-		case "query_id":
-			res.QueryId = value
-		case "user":
-			var user WebInitUser
-			err = json.Unmarshal([]byte(value), &user)
-			if err != nil {
-				return
-			}
-			res.User = user
+	res.Hash = recvHash
+	for _, kv := range data {
+		key, value, _ := strings.Cut(kv, "=")
+		if err = res.setField(key, value); err != nil {
+			return AuthInfo{}, fmt.Errorf("parse %s: %w", key, err)
 		}
 	}
 	return
 }
+
+// replayKey 返回标识这份 initData 的值，用于拒绝重放
+func (a AuthInfo) replayKey() string {
+	if a.Hash != "" {
+		return a.Hash
+	}
+	return a.Signature
+}
+
+// authDateClockSkew 为允许的 auth_date 超前于本机时间的误差
+const authDateClockSkew = 30 * time.Second
+
 func verifyHeader(ctx *gin.Context) {
 	if cfg.Testing {
 		log.Println("[verifyHeader] 测试模式，跳过验证")
@@ -125,11 +237,8 @@ func verifyHeader(ctx *gin.Context) {
 			Hash:     "0xdeadbeef",
 		}
 		ctx.Set("auth", auth)
-		userStatus.LoadOrCompute(auth.User.Id, func() (*UserJoinEvent, bool) {
-			e := &UserJoinEvent{}
-			e.Init(auth.User.Id, auth.User.Username, defaultVerificationTimeout)
-			return e, false
-		})
+		// 测试用户没有真实的入群请求，使用群组0作为其验证会话
+		loadOrStartSession(sessionKey{UserId: auth.User.Id}, auth.User.Username, DefaultGroupConfig(0), TriggerTesting)
 		ctx.Next()
 		return
 	}
@@ -137,27 +246,32 @@ func verifyHeader(ctx *gin.Context) {
 	log.Printf("[verifyHeader] Authorization Header: %s", authHeader)
 	if authHeader == "" {
 		log.Println("[verifyHeader] 缺少 Authorization Header")
-		ctx.AbortWithStatusJSON(401, hErr("请确定您在Telegram中打开本页面，而不是在独立浏览器中"))
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.open_in_telegram"))
 		return
 	}
 
 	const TelegramPrefix = "Telegram "
 	if !strings.HasPrefix(authHeader, TelegramPrefix) {
 		log.Println("[verifyHeader] Authorization Header 无效前缀")
-		ctx.AbortWithStatusJSON(401, hErr("请确定您在Telegram中打开本页面，而不是在独立浏览器中，或者可能出现问题，请联系开发者"))
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.open_in_telegram_or_contact"))
 		return
 	}
 
 	data := authHeader[len(TelegramPrefix):]
-	auth, err := checkTelegramAuth(data, botVerifyKey())
+	auth, err := checkTelegramAuth(data, initDataAuth)
 	if err != nil {
 		log.Printf("[verifyHeader] Telegram 验证失败: %v", err)
-		ctx.AbortWithStatusJSON(401, hErr("验证用于身份失败"+err.Error()))
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.auth_failed", "error", err.Error()))
 		return
 	}
-	if time.Since(auth.AuthDate) > 5*time.Minute {
+	if time.Until(auth.AuthDate) > authDateClockSkew {
+		log.Printf("[verifyHeader] auth_date 晚于当前时间: %s", auth.AuthDate)
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.auth_date_future"))
+		return
+	}
+	if time.Since(auth.AuthDate) > cfg.InitDataMaxAge {
 		log.Printf("[verifyHeader] 数据过期: %s", auth.AuthDate)
-		ctx.AbortWithStatusJSON(401, hErr("数据过期，该网页验证时长已超过5分钟，需要重新打开网页验证"))
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.auth_expired", "duration", formatDuration(requestLanguage(ctx), cfg.InitDataMaxAge)))
 		return
 	}
 	log.Printf("[verifyHeader] 通过用户验证: %d", auth.User.Id)
@@ -165,101 +279,233 @@ func verifyHeader(ctx *gin.Context) {
 	ctx.Next()
 }
 
-type TurnstileToken struct {
+type ChallengeToken struct {
 	Token string `json:"token"`
 }
-type TurnstileResp struct {
-	Success     bool      `json:"success"`
-	ChallengeTs time.Time `json:"challenge_ts,omitempty"`
-	Hostname    string    `json:"hostname,omitempty"`
-	ErrorCodes  []string  `json:"error-codes,omitempty"`
-	Action      string    `json:"action,omitempty"`
-	Cdata       string    `json:"cdata,omitempty"`
-	Metadata    struct {
-		EphemeralID string `json:"ephemeral_id,omitempty"`
-	} `json:"metadata,omitempty"`
+
+// pendingSessions 取出当前用户一次验证可以作用到的会话，没有时直接返回错误响应。
+// 通过带 token 的链接打开时只处理 token 对应的会话，否则处理所有可以共用这次验证的会话。
+func pendingSessions(ctx *gin.Context) ([]*UserJoinEvent, bool) {
+	auth := ctx.MustGet("auth").(AuthInfo)
+	var sessions []*UserJoinEvent
+	if auth.StartParam != "" {
+		key, err := parseStartToken(auth.StartParam, time.Now())
+		switch {
+		case errors.Is(err, errStartTokenExpired):
+			log.Printf("[pendingSessions] 用户 %d 的验证链接已过期: %v", auth.User.Id, err)
+			ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.link_expired"))
+			return nil, false
+		case err != nil:
+			log.Printf("[pendingSessions] 用户 %d 的 start_param 无效: %v", auth.User.Id, err)
+			ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.link_invalid"))
+			return nil, false
+		case key.UserId != auth.User.Id:
+			log.Printf("[pendingSessions] 用户 %d 打开了发给用户 %d 的验证链接", auth.User.Id, key.UserId)
+			ctx.AbortWithStatusJSON(403, hErrT(ctx, "api.link_not_yours"))
+			return nil, false
+		}
+		if event, ok := userStatus.Load(key); ok && event.State() == userVerifying {
+			sessions = []*UserJoinEvent{event}
+		}
+	} else {
+		sessions = sessionsSettledByPass(auth.User.Id)
+	}
+	if len(sessions) == 0 {
+		log.Printf("[pendingSessions] 用户 %d 没有进行中的验证", auth.User.Id)
+		ctx.AbortWithStatusJSON(404, hErrT(ctx, "api.no_pending_session"))
+		return nil, false
+	}
+	return sessions, true
 }
 
-func verifyTurnstile(ctx *gin.Context) {
-	log.Println("[verifyTurnstile] 开始人类验证")
-	const cfSiteVerify = `https://challenges.cloudflare.com/turnstile/v0/siteverify`
-	cfIp := ctx.GetHeader("CF-Connecting-IP")
-	log.Printf("[verifyTurnstile] CF-Connecting-IP: %s", cfIp)
+// ownSession 返回本次验证失败时计入的会话：带有效 token 时是 token 对应的会话，
+// 否则是截止时间最早的会话，与 verifyChallenge 判定失败的会话一致。没有时返回 nil
+func ownSession(auth AuthInfo) *UserJoinEvent {
+	if auth.StartParam != "" {
+		key, err := parseStartToken(auth.StartParam, time.Now())
+		if err != nil || key.UserId != auth.User.Id {
+			return nil
+		}
+		if event, ok := userStatus.Load(key); ok && event.State() == userVerifying {
+			return event
+		}
+		return nil
+	}
+	if sessions := sessionsSettledByPass(auth.User.Id); len(sessions) > 0 {
+		return sessions[0]
+	}
+	return nil
+}
 
-	var token TurnstileToken
-	if err := ctx.ShouldBindBodyWithJSON(&token); err != nil {
-		log.Println("[verifyTurnstile] 缺少 Turnstile token")
-		ctx.AbortWithStatusJSON(401, hErr("没有token"))
+// challengePage 返回用户需要完成的人机验证的页面参数，验证服务由截止时间最早的会话所在群组决定
+func challengePage(ctx *gin.Context) {
+	sessions, ok := pendingSessions(ctx)
+	if !ok {
 		return
 	}
-	log.Printf("[verifyTurnstile] 接收到 token: %s", token.Token)
+	auth := ctx.MustGet("auth").(AuthInfo)
+	provider := challengeProviderFor(sessions[0].ChatId)
+	ctx.JSON(http.StatusOK, gin.H{"success": true, "data": provider.Page(auth.User.Id)})
+}
 
-	form := make(url.Values)
-	form.Set("secret", cfg.TurnstileSecret)
-	form.Set("response", token.Token)
-	if cfIp != "" {
-		form.Set("remoteip", cfIp)
+// newCaptcha 为使用内置验证码的用户生成一道新题目，图片以 data URL 返回，便于页面携带认证头获取
+func newCaptcha(ctx *gin.Context) {
+	if _, ok := pendingSessions(ctx); !ok {
+		return
 	}
-	resp, err := http.PostForm(cfSiteVerify, form)
+	id, img, err := builtinCaptchas.New()
 	if err != nil {
-		log.Printf("[verifyTurnstile] 访问 Cloudflare 验证接口失败: %v", err)
-		ctx.AbortWithStatusJSON(401, hErr("访问cloudflare失败，这应该不是您的问题"))
+		log.Printf("[newCaptcha] 生成验证码失败: %v", err)
+		ctx.AbortWithStatusJSON(500, hErrT(ctx, "api.captcha_failed"))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"id": id, "image": captchaDataURL(img)}})
+}
+
+func verifyChallenge(ctx *gin.Context) {
+	log.Println("[verifyChallenge] 开始人类验证")
+	cfIp := ctx.ClientIP()
+	log.Printf("[verifyChallenge] 用户IP: %s", cfIp)
+
+	var token ChallengeToken
+	if err := ctx.ShouldBindBodyWithJSON(&token); err != nil {
+		log.Println("[verifyChallenge] 缺少验证 token")
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.no_token"))
 		return
 	}
-	defer resp.Body.Close()
+	log.Printf("[verifyChallenge] 接收到 token: %s", token.Token)
 
 	auth := ctx.MustGet("auth").(AuthInfo)
-	event, _ := userStatus.LoadOrCompute(auth.User.Id, func() (*UserJoinEvent, bool) {
-		e := &UserJoinEvent{}
-		e.Init(auth.User.Id, auth.User.Username, defaultVerificationTimeout)
-		return e, false
-	})
-	event.UpdateUsername(auth.User.Username)
-	var data TurnstileResp
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		log.Printf("[verifyTurnstile] JSON 解码失败: %v", err)
-		ctx.AbortWithStatusJSON(401, hErr("解码cloudflare响应失败，这应该不是您的问题"))
+	sessions, ok := pendingSessions(ctx)
+	if !ok {
 		return
 	}
+	for _, event := range sessions {
+		event.UpdateUsername(auth.User.Username)
+	}
 
-	if !data.Success {
-		log.Printf("[verifyTurnstile] Turnstile 验证失败: %v", data.ErrorCodes)
-		event.SetState(userVerifyFailed)
-		ctx.AbortWithStatusJSON(401, hErr("人类验证失败！"))
+	provider := challengeProviderFor(sessions[0].ChatId)
+	// 先标记再校验，避免同一个 token 并发提交时都通过校验
+	if !usedTokens.use(replayKindChallenge, token.Token, time.Now().Add(cfg.ChallengeMaxAge)) {
+		log.Printf("[verifyChallenge] 用户 %d 提交了已经使用过的 token", auth.User.Id)
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.token_replayed"))
 		return
 	}
+	result, err := provider.Verify(ctx.Request.Context(), token.Token, cfIp)
+	if err != nil {
+		log.Printf("[verifyChallenge] 访问 %s 验证接口失败: %v", provider.Name(), err)
+		// 没有得到验证接口的结果，token 可能仍然有效，撤销标记让用户可以重试
+		usedTokens.release(replayKindChallenge, token.Token)
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.siteverify_failed"))
+		return
+	}
+
+	if result.Success {
+		if codes := checkChallengeResult(provider.Page(auth.User.Id), result, time.Now()); len(codes) > 0 {
+			log.Printf("[verifyChallenge] 用户 %d 的 %s 校验结果不符合: %v, hostname=%s action=%s",
+				auth.User.Id, provider.Name(), codes, result.Hostname, result.Action)
+			result.Success = false
+			result.ErrorCodes = append(result.ErrorCodes, codes...)
+		}
+	}
+	if !result.Success {
+		log.Printf("[verifyChallenge] %s 验证失败: %v", provider.Name(), result.ErrorCodes)
+		observeChallengeFailure(provider.Name(), result.ErrorCodes)
+		// 内置验证码答错时换一道题重试，机会用完才判定失败
+		if provider.Name() == providerBuiltin {
+			if left := sessions[0].MissCaptcha(); left > 0 {
+				resp := hErrT(ctx, "api.captcha_wrong", "attempts", strconv.Itoa(left))
+				resp["retry"] = true
+				ctx.AbortWithStatusJSON(401, resp)
+				return
+			}
+		}
+		// 共用验证只是让一次通过可以作用到多个群组，失败只算在本次验证所属的会话上：
+		// 带 token 打开时是 token 对应的会话，否则是截止时间最早的会话
+		change := StateChange{Trigger: VerificationTrigger(provider.Name()), ErrorCodes: result.ErrorCodes, ClientIP: cfIp}
+		sessions[0].SetState(userVerifyFailed, change)
+		settleInitData(ctx)
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.verify_failed"))
+		return
+	}
+
+	log.Printf("[verifyChallenge] 用户 %d 通过 %s 人类验证", auth.User.Id, provider.Name())
+	// 在响应之前记录，页面收到响应后打开的推送连接只展示这些群组
+	chats := make([]int64, 0, len(sessions))
+	for _, event := range sessions {
+		chats = append(chats, event.ChatId)
+	}
+	sessionStatuses.recordPass(auth.User.Id, chats)
+	settleInitData(ctx)
+	ctx.JSON(http.StatusOK, gin.H{"success": true, "data": tr(requestLanguage(ctx), "api.verify_succeeded")})
+	change := StateChange{Trigger: VerificationTrigger(provider.Name()), ClientIP: cfIp}
+	for _, event := range sessions {
+		event.SetState(userVerifySucceed, change)
+	}
+}
 
-	log.Printf("[verifyTurnstile] 用户 %d 人类验证通过", auth.User.Id)
-	ctx.JSON(http.StatusOK, gin.H{"success": true, "data": "人类验证成功！"})
-	event.SetState(userVerifySucceed)
+// verifyHandlers 返回提交人类验证结果的处理链
+func verifyHandlers() []gin.HandlerFunc {
+	return []gin.HandlerFunc{
+		verifyHeader,
+		rateLimitVerify(newRateLimiter(cfg.VerifyUserRate, cfg.VerifyUserBurst), newRateLimiter(cfg.VerifyIPRate, cfg.VerifyIPBurst)),
+		rejectReplayedInitData,
+		verifyChallenge,
+	}
 }
 
 func mainPage(ctx *gin.Context) {
 	ctx.Data(200, "text/html; charset=utf-8", mainHtml)
 }
 
-func initHttp() {
+// initHttp 在后台启动 HTTP 服务，返回的 http.Server 用于关闭程序时停止服务
+func initHttp(b *gotgbot.Bot, updater *ext.Updater) *http.Server {
 	if !cfg.Testing {
 		gin.SetMode(gin.ReleaseMode)
 	}
-	mainHtml = bytes.ReplaceAll(mainHtml, []byte("1x00000000000000000000AA"), []byte(cfg.TurnstileSiteKey))
 	r := gin.Default()
-	err := r.SetTrustedProxies([]string{"127.0.0.1", "::1"})
+	// 只有来自信任代理的请求才会使用这些头中的地址，否则用户可以伪造IP绕过限流
+	r.RemoteIPHeaders = []string{"CF-Connecting-IP", "X-Forwarded-For", "X-Real-IP"}
+	err := r.SetTrustedProxies(cfg.TrustedProxies)
 	if err != nil {
-		log.Fatalf("[initHttp] 信任127.0.0.1代理失败: %v", err)
+		log.Fatalf("[initHttp] 设置信任代理 %v 失败: %v", cfg.TrustedProxies, err)
 	}
 	r.GET("/", mainPage)
-	r.POST("/verify", verifyHeader, verifyTurnstile)
-	if cfg.TlsKeyPath != "" && cfg.TlsCertPath != "" {
-		err := r.RunTLS(cfg.ListenAddress, cfg.TlsCertPath, cfg.TlsKeyPath)
-		if err != nil {
-			panic(err)
-		}
-		return
+	r.GET("/messages", webMessages)
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz(b))
+	if cfg.AdminToken != "" {
+		// 指标中包含群组id，配置了管理token时同样需要使用该token抓取
+		r.GET("/metrics", adminAuth, gin.WrapH(promhttp.Handler()))
+	} else {
+		r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	}
-	fmt.Println("You can use DIO_TLS_CERT and DIO_TLS_KEY env var to serve https")
-	err = r.Run(cfg.ListenAddress)
-	if err != nil {
-		panic(err)
+	r.GET("/challenge", verifyHeader, challengePage)
+	r.GET("/captcha", verifyHeader, newCaptcha)
+	r.POST("/verify", verifyHandlers()...)
+	r.GET("/status", verifyHeader, statusStream)
+	if cfg.AdminToken != "" {
+		// 页面本身不包含数据，所有数据都通过需要 token 的管理接口获取
+		r.GET("/admin", adminPage)
+		registerAdminAPI(r.Group("/admin/api", adminAuth))
+	}
+	if cfg.WebhookURL != "" {
+		// 密钥由 updater 根据 X-Telegram-Bot-Api-Secret-Token 校验，更新会交给同一个 dispatcher 处理
+		r.POST("/"+webhookPath, gin.WrapF(updater.GetHandlerFunc("/")))
 	}
+	srv := &http.Server{Addr: cfg.ListenAddress, Handler: r.Handler()}
+	srv.RegisterOnShutdown(sessionStatuses.closeAll)
+	go func() {
+		var err error
+		if cfg.TlsKeyPath != "" && cfg.TlsCertPath != "" {
+			err = srv.ListenAndServeTLS(cfg.TlsCertPath, cfg.TlsKeyPath)
+		} else {
+			fmt.Println("You can use DIO_TLS_CERT and DIO_TLS_KEY env var to serve https")
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+	return srv
 }
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/puzpuzpuz/xsync/v4"
+)
+
+const testBotToken = "123456:test-token"
+
+// signInitData 按 Telegram 的规则生成带 hash 与 signature 的 initData
+func signInitData(t *testing.T, fields url.Values, privateKey ed25519.PrivateKey) string {
+	t.Helper()
+	var pairs []string
+	for k := range fields {
+		pairs = append(pairs, k+"="+fields.Get(k))
+	}
+	slices.Sort(pairs)
+	sig := ed25519.Sign(privateKey, []byte("123456:WebAppData\n"+strings.Join(pairs, "\n")))
+	signed := url.Values{}
+	for k := range fields {
+		signed.Set(k, fields.Get(k))
+	}
+	signed.Set("signature", base64.RawURLEncoding.EncodeToString(sig))
+
+	pairs = pairs[:0]
+	for k := range signed {
+		pairs = append(pairs, k+"="+signed.Get(k))
+	}
+	slices.Sort(pairs)
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(testBotToken))
+	mac := hmac.New(sha256.New, secret.Sum(nil))
+	mac.Write([]byte(strings.Join(pairs, "\n")))
+	signed.Set("hash", hex.EncodeToString(mac.Sum(nil)))
+	return signed.Encode()
+}
+
+func TestCheckTelegramAuth(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := url.Values{
+		"query_id":  {"AAHdF6IQAAAAAN0XohDhrOrc"},
+		"user":      {`{"id":279058397,"first_name":"Vladislav","username":"vdkfrost","language_code":"ru"}`},
+		"auth_date": {"1662771648"},
+	}
+	initData := signInitData(t, fields, privateKey)
+	tampered := strings.Replace(initData, "auth_date=1662771648", "auth_date=1662771649", 1)
+
+	hmacOnly, err := newInitDataVerifier(testBotToken, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第三方校验服务只有公钥与 bot id
+	sigOnly, err := newInitDataVerifier("", hex.EncodeToString(publicKey), 123456)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]initDataVerifier{"hash": hmacOnly, "signature": sigOnly} {
+		auth, err := checkTelegramAuth(initData, v)
+		if err != nil {
+			t.Fatalf("%s: check failed: %v", name, err)
+		}
+		if auth.User.Id != 279058397 || auth.QueryId != "AAHdF6IQAAAAAN0XohDhrOrc" || auth.AuthDate.Unix() != 1662771648 || auth.Signature == "" {
+			t.Fatalf("%s: unexpected auth info: %+v", name, auth)
+		}
+		if _, err := checkTelegramAuth(tampered, v); err == nil {
+			t.Fatalf("%s: expected tampered initData to be rejected", name)
+		}
+	}
+
+	if _, err := checkTelegramAuth(initData, initDataVerifier{}); err == nil {
+		t.Fatal("expected initData to be rejected without any key")
+	}
+	if _, err := newInitDataVerifier("", hex.EncodeToString(publicKey), 0); err == nil {
+		t.Fatal("expected error without bot id")
+	}
+	if _, err := newInitDataVerifier(testBotToken, "not-hex", 0); err == nil {
+		t.Fatal("expected error for invalid public key")
+	}
+	if v, _ := newInitDataVerifier(testBotToken, hex.EncodeToString(publicKey), 0); v.botId != 123456 {
+		t.Fatalf("expected bot id from token, got %d", v.botId)
+	}
+	if _, err := checkTelegramAuth(fmt.Sprintf("%s&hash=%s", fields.Encode(), "short"), hmacOnly); err == nil {
+		t.Fatal("expected short hash to be rejected")
+	}
+}
+
+func TestCheckTelegramAuthFullInitData(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initData := signInitData(t, url.Values{
+		"user":           {`{"id":1,"is_bot":false,"first_name":"A","last_name":"B","username":"ab","language_code":"zh-hans","is_premium":true,"added_to_attachment_menu":true,"allows_write_to_pm":true,"photo_url":"https://t.me/i/userpic/1.jpg"}`},
+		"receiver":       {`{"id":2,"is_bot":true,"first_name":"Bot"}`},
+		"chat":           {`{"id":-1001,"type":"supergroup","title":"Group","username":"group","photo_url":"https://t.me/i/chat.jpg"}`},
+		"chat_type":      {"supergroup"},
+		"chat_instance":  {"-4242"},
+		"start_param":    {"join_-1001"},
+		"can_send_after": {"10"},
+		"auth_date":      {"1700000000"},
+		"unknown_field":  {"ignored"},
+	}, privateKey)
+	v, err := newInitDataVerifier(testBotToken, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := checkTelegramAuth(initData, v)
+	if err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	expectedUser := WebInitUser{Id: 1, FirstName: "A", LastName: "B", Username: "ab", LanguageCode: "zh-hans", IsPremium: true,
+		AddedToAttachmentMenu: true, AllowsWriteToPm: true, PhotoUrl: "https://t.me/i/userpic/1.jpg"}
+	if auth.User != expectedUser {
+		t.Fatalf("unexpected user: %+v", auth.User)
+	}
+	if auth.Receiver == nil || *auth.Receiver != (WebInitUser{Id: 2, IsBot: true, FirstName: "Bot"}) {
+		t.Fatalf("unexpected receiver: %+v", auth.Receiver)
+	}
+	if auth.Chat == nil || *auth.Chat != (WebInitChat{Id: -1001, Type: "supergroup", Title: "Group", Username: "group", PhotoUrl: "https://t.me/i/chat.jpg"}) {
+		t.Fatalf("unexpected chat: %+v", auth.Chat)
+	}
+	if auth.ChatType != "supergroup" || auth.ChatInstance != "-4242" || auth.StartParam != "join_-1001" ||
+		auth.CanSendAfter != 10*time.Second || auth.AuthDate.Unix() != 1700000000 || auth.Hash == "" {
+		t.Fatalf("unexpected auth info: %+v", auth)
+	}
+}
+
+func TestAuthInfoSetField(t *testing.T) {
+	var a AuthInfo
+	for _, kv := range [][2]string{{"user", "{bad"}, {"chat", "[]"}, {"can_send_after", "soon"}, {"auth_date", ""}} {
+		if err := a.setField(kv[0], kv[1]); err == nil {
+			t.Fatalf("expected error for %s=%q", kv[0], kv[1])
+		}
+	}
+	if err := a.setField("hash", "abc"); err != nil || a.Hash != "abc" {
+		t.Fatalf("unexpected hash parse: %q %v", a.Hash, err)
+	}
+	if a.Receiver != nil {
+		t.Fatal("expected receiver to stay nil when absent")
+	}
+}
+
+// startBuiltinSessions 为同一用户在多个群组开启使用内置验证码的会话，截止时间按顺序递增
+func startBuiltinSessions(t *testing.T, keys ...sessionKey) []*UserJoinEvent {
+	t.Helper()
+	// 每个测试使用独立的 token 记录，重复运行时不会被当作重放
+	oldTokens := usedTokens
+	usedTokens = &replayGuard{used: xsync.NewMap[string, time.Time]()}
+	t.Cleanup(func() { usedTokens = oldTokens })
+	var events []*UserJoinEvent
+	for i, key := range keys {
+		gc := DefaultGroupConfig(key.ChatId)
+		gc.ChallengeProvider = providerBuiltin
+		gc.VerificationTimeoutSeconds += i * 60
+		if err := persistentStore.UpsertGroupConfig(gc); err != nil {
+			t.Fatal(err)
+		}
+		event, _ := loadOrStartSession(key, "", gc, TriggerJoinRequest)
+		events = append(events, event)
+		t.Cleanup(func() { userStatus.Delete(key) })
+	}
+	return events
+}
+
+func postVerify(userId int64, startParam, token string) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.POST("/verify", func(ctx *gin.Context) {
+		ctx.Set("auth", AuthInfo{User: WebInitUser{Id: userId}, StartParam: startParam})
+	}, verifyChallenge)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(fmt.Sprintf(`{"token":%q}`, token))))
+	return w
+}
+
+func TestVerifyChallengeFailureOnlyFailsOwnSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	first := sessionKey{UserId: 575757, ChatId: -100575701}
+	second := sessionKey{UserId: 575757, ChatId: -100575702}
+	third := sessionKey{UserId: 575757, ChatId: -100575703}
+	events := startBuiltinSessions(t, first, second, third)
+
+	for i := range captchaAttempts {
+		if w := postVerify(first.UserId, "", fmt.Sprintf("no-such-captcha:%d", i)); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected the wrong answer to be rejected, got %d", w.Code)
+		}
+	}
+	if events[0].State() != userVerifyFailed || events[1].State() != userVerifying || events[2].State() != userVerifying {
+		t.Fatalf("expected only the earliest session to fail, got %v %v %v", events[0].State(), events[1].State(), events[2].State())
+	}
+
+	// 带 token 打开时失败只算在 token 对应的会话上
+	startParam := newStartToken(third, time.Now().Add(time.Minute))
+	for i := range captchaAttempts {
+		if w := postVerify(third.UserId, startParam, fmt.Sprintf("wrong-captcha:%d", i)); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected the wrong answer to be rejected, got %d", w.Code)
+		}
+	}
+	if events[1].State() != userVerifying || events[2].State() != userVerifyFailed {
+		t.Fatalf("expected only the session of the token to fail, got %v %v", events[1].State(), events[2].State())
+	}
+}
+
+func TestVerifyChallengeBuiltinAttempts(t *testing.T) {
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	// 经过完整的处理链，页面在同一次打开中用同一份 initData 多次提交
+	r, sign := verifyRoute(t)
+	key := sessionKey{UserId: 585858, ChatId: -100585858}
+	event := startBuiltinSessions(t, key)[0]
+	initData := sign(key.UserId)
+	for i := range captchaAttempts - 1 {
+		w := postVerifyRoute(r, initData, fmt.Sprintf("retry-captcha:%d", i))
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `"retry":true`) {
+			t.Fatalf("expected a retry response, got %d %s", w.Code, w.Body.String())
+		}
+		if event.State() != userVerifying {
+			t.Fatalf("expected the session to keep verifying after %d wrong answers", i+1)
+		}
+	}
+
+	// 换题后答对依然可以通过
+	id, _, err := builtinCaptchas.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := builtinCaptchas.entries.Load(id)
+	if w := postVerifyRoute(r, initData, id+":"+entry.answer); w.Code != http.StatusOK {
+		t.Fatalf("expected the right answer to pass, got %d %s", w.Code, w.Body.String())
+	}
+	if event.State() != userVerifySucceed {
+		t.Fatalf("expected the session to succeed, got %v", event.State())
+	}
+
+	// 机会用完时判定失败
+	failing := sessionKey{UserId: 585859, ChatId: -100585859}
+	event = startBuiltinSessions(t, failing)[0]
+	initData = sign(failing.UserId)
+	for i := range captchaAttempts {
+		if w := postVerifyRoute(r, initData, fmt.Sprintf("wrong-captcha:%d", i)); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected the wrong answer to be rejected, got %d %s", w.Code, w.Body.String())
+		}
+	}
+	if event.State() != userVerifyFailed {
+		t.Fatalf("expected the session to fail once attempts run out, got %v", event.State())
+	}
+}
+
+// verifyRoute 返回与 initHttp 相同的 /verify 处理链，以及为 userId 签发 initData 的函数
+func verifyRoute(t *testing.T) (*gin.Engine, func(userId int64) string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := newInitDataVerifier(testBotToken, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldAuth, oldTokens, oldCfg := initDataAuth, usedTokens, cfg
+	initDataAuth = verifier
+	usedTokens = &replayGuard{used: xsync.NewMap[string, time.Time]()}
+	cfg.Testing = false
+	cfg.InitDataMaxAge = time.Hour
+	cfg.VerifyUserRate, cfg.VerifyUserBurst = 60, 10
+	cfg.VerifyIPRate, cfg.VerifyIPBurst = 60, 10
+	t.Cleanup(func() { initDataAuth, usedTokens, cfg = oldAuth, oldTokens, oldCfg })
+
+	r := gin.New()
+	r.POST("/verify", verifyHandlers()...)
+	return r, func(userId int64) string {
+		return signInitData(t, url.Values{
+			"user":      {fmt.Sprintf(`{"id":%d,"first_name":"test"}`, userId)},
+			"auth_date": {strconv.FormatInt(time.Now().Unix(), 10)},
+		}, privateKey)
+	}
+}
+
+func postVerifyRoute(r *gin.Engine, initData, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(fmt.Sprintf(`{"token":%q}`, token)))
+	req.Header.Set("Authorization", "Telegram "+initData)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// stubProvider 是按 verify 返回结果的验证服务
+type stubProvider struct {
+	verify func(token string) (ChallengeResult, error)
+}
+
+func (p stubProvider) Name() string { return "stub" }
+
+func (p stubProvider) Page(int64) ChallengePage { return ChallengePage{Provider: "stub"} }
+
+func (p stubProvider) Verify(_ context.Context, token, _ string) (ChallengeResult, error) {
+	return p.verify(token)
+}
+
+func TestVerifyRouteRetriesAfterSiteVerifyError(t *testing.T) {
+	oldStore, oldProviders := persistentStore, challengeProviders
+	persistentStore = newTestStore(t)
+	var calls int
+	stub := stubProvider{verify: func(string) (ChallengeResult, error) {
+		calls++
+		if calls == 1 {
+			return ChallengeResult{}, errors.New("connection reset")
+		}
+		return ChallengeResult{Success: true}, nil
+	}}
+	challengeProviders = func() map[string]ChallengeProvider {
+		return map[string]ChallengeProvider{"stub": stub}
+	}
+	t.Cleanup(func() { persistentStore, challengeProviders = oldStore, oldProviders })
+
+	r, sign := verifyRoute(t)
+	key := sessionKey{UserId: 595959, ChatId: -100595959}
+	gc := DefaultGroupConfig(key.ChatId)
+	gc.ChallengeProvider = "stub"
+	if err := persistentStore.UpsertGroupConfig(gc); err != nil {
+		t.Fatal(err)
+	}
+	event, _ := loadOrStartSession(key, "", gc, TriggerJoinRequest)
+	t.Cleanup(func() { userStatus.Delete(key) })
+
+	// 验证接口出错时 initData 与 token 都没有用掉，页面可以原样重试
+	initData := sign(key.UserId)
+	if w := postVerifyRoute(r, initData, "token"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), tr(resolveLanguage(), "api.siteverify_failed")) {
+		t.Fatalf("expected a siteverify error, got %d %s", w.Code, w.Body.String())
+	}
+	if w := postVerifyRoute(r, initData, "token"); w.Code != http.StatusOK {
+		t.Fatalf("expected the retry to pass, got %d %s", w.Code, w.Body.String())
+	}
+	if event.State() != userVerifySucceed {
+		t.Fatalf("expected the session to succeed, got %v", event.State())
+	}
+	// 有了结果之后同一份 initData 不能再次提交
+	if w := postVerifyRoute(r, initData, "other-token"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), tr(resolveLanguage(), "api.page_replayed")) {
+		t.Fatalf("expected the settled initData to be rejected, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 消息目录为 locales 下以语言标签命名的 JSON 文件，内容是消息 key 到文本的映射，
+// 文本中的 {name} 占位符由调用方按名字替换。LOCALES_DIR 中的同名文件会覆盖内置的文本，
+// 其他文件会作为新的语言加入，不需要修改代码。
+//
+//go:embed locales/*.json
+var embeddedLocales embed.FS
+
+// fallbackLanguage 的目录包含全部消息，其他语言缺少的消息使用它补全
+const fallbackLanguage = "zh-CN"
+
+type messageCatalog map[string]string
+
+var catalogs = mustLoadEmbeddedCatalogs()
+
+func mustLoadEmbeddedCatalogs() map[string]messageCatalog {
+	fsys, err := fs.Sub(embeddedLocales, "locales")
+	if err != nil {
+		panic(err)
+	}
+	result, err := loadCatalogs(fsys, nil)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// loadCatalogs 读取 fsys 根目录下的所有 JSON 目录，合并到 base 的副本中返回
+func loadCatalogs(fsys fs.FS, base map[string]messageCatalog) (map[string]messageCatalog, error) {
+	result := make(map[string]messageCatalog, len(base))
+	for lang, catalog := range base {
+		result[lang] = maps.Clone(catalog)
+	}
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		var messages messageCatalog
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", file, err)
+		}
+		lang := strings.TrimSuffix(file, ".json")
+		if result[lang] == nil {
+			result[lang] = messageCatalog{}
+		}
+		maps.Copy(result[lang], messages)
+	}
+	return result, nil
+}
+
+// loadExtraCatalogs 在启动时加载 LOCALES_DIR 中的目录
+func loadExtraCatalogs(dir string) error {
+	merged, err := loadCatalogs(os.DirFS(dir), catalogs)
+	if err != nil {
+		return err
+	}
+	catalogs = merged
+	return nil
+}
+
+func availableLanguages() []string {
+	return slices.Sorted(maps.Keys(catalogs))
+}
+
+// matchLanguage 将 Telegram 的 language_code 或 Accept-Language 中的语言标签对应到已有的目录，
+// 先精确匹配，再按主语言匹配（例如 zh-hans 对应 zh-CN，en-US 对应 en），找不到时返回空字符串
+func matchLanguage(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "_", "-"))
+	if code == "" {
+		return ""
+	}
+	base, _, _ := strings.Cut(code, "-")
+	match := ""
+	for _, lang := range availableLanguages() {
+		l := strings.ToLower(lang)
+		if l == code {
+			return lang
+		}
+		if lBase, _, _ := strings.Cut(l, "-"); lBase == base && (match == "" || l == base) {
+			match = lang
+		}
+	}
+	return match
+}
+
+// resolveLanguage 返回第一个有对应目录的语言，都没有时使用默认语言
+func resolveLanguage(codes ...string) string {
+	for _, code := range codes {
+		if lang := matchLanguage(code); lang != "" {
+			return lang
+		}
+	}
+	if cfg.DefaultLanguage != "" {
+		return cfg.DefaultLanguage
+	}
+	return fallbackLanguage
+}
+
+// groupLanguage 返回群组消息使用的语言，群组没有配置时使用默认语言
+func groupLanguage(chatId int64) string {
+	return resolveLanguage(loadGroupConfig(chatId).Language)
+}
+
+// tr 返回 lang 中 key 对应的文本，args 为成对的占位符名字与值。
+// 缺少的消息依次使用默认语言与 fallbackLanguage，都没有时返回 key 本身。
+func tr(lang, key string, args ...string) string {
+	text, ok := catalogs[lang][key]
+	if !ok {
+		text, ok = catalogs[cfg.DefaultLanguage][key]
+	}
+	if !ok {
+		text, ok = catalogs[fallbackLanguage][key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, len(args))
+	for i := 0; i+1 < len(args); i += 2 {
+		pairs = append(pairs, "{"+args[i]+"}", args[i+1])
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// messagesWithPrefix 返回 lang 中以 prefix 开头的全部消息，缺少的同样按 tr 的规则补全
+func messagesWithPrefix(lang, prefix string) map[string]string {
+	result := make(map[string]string)
+	for _, l := range []string{fallbackLanguage, cfg.DefaultLanguage, lang} {
+		for key, text := range catalogs[l] {
+			if strings.HasPrefix(key, prefix) {
+				result[key] = text
+			}
+		}
+	}
+	return result
+}
+
+// messageError 是需要展示给用户的错误，展示时按用户的语言翻译，参数中的 time.Duration 按语言格式化
+type messageError struct {
+	key  string
+	args []any
+}
+
+func newMessageError(key string, args ...any) error {
+	return &messageError{key: key, args: args}
+}
+
+func (e *messageError) text(lang string) string {
+	args := make([]string, len(e.args))
+	for i, arg := range e.args {
+		if d, ok := arg.(time.Duration); ok {
+			args[i] = formatDuration(lang, d)
+		} else {
+			args[i] = fmt.Sprint(arg)
+		}
+	}
+	return tr(lang, e.key, args...)
+}
+
+func (e *messageError) Error() string {
+	return e.text(resolveLanguage())
+}
+
+// errorText 返回错误在 lang 中的文本，其他错误原样返回
+func errorText(lang string, err error) string {
+	var m *messageError
+	if errors.As(err, &m) {
+		return m.text(lang)
+	}
+	return err.Error()
+}
+
+// acceptLanguages 返回 Accept-Language 中的语言标签，忽略权重，按出现顺序排列
+func acceptLanguages(ctx *gin.Context) []string {
+	var tags []string
+	for _, part := range strings.Split(ctx.GetHeader("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(part, ";")
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// requestLanguage 返回网页请求使用的语言，通过认证后使用 Telegram 用户的语言，否则使用 Accept-Language
+func requestLanguage(ctx *gin.Context) string {
+	var codes []string
+	if v, ok := ctx.Get("auth"); ok {
+		codes = append(codes, v.(AuthInfo).User.LanguageCode)
+	}
+	return resolveLanguage(append(codes, acceptLanguages(ctx)...)...)
+}
+
+// hErrT 与 hErr 相同，错误信息按请求的语言翻译
+func hErrT(ctx *gin.Context, key string, args ...string) gin.H {
+	return hErr(tr(requestLanguage(ctx), key, args...))
+}
+
+// webMessages 返回验证页面需要的消息，lang 参数为页面取得的 Telegram 用户语言
+func webMessages(ctx *gin.Context) {
+	lang := resolveLanguage(append([]string{ctx.Query("lang")}, acceptLanguages(ctx)...)...)
+	ctx.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"lang": lang, "messages": messagesWithPrefix(lang, "web.")}})
+}
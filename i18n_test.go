@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCatalogsAreComplete(t *testing.T) {
+	expected := slices.Sorted(maps.Keys(catalogs[fallbackLanguage]))
+	for lang, catalog := range catalogs {
+		if keys := slices.Sorted(maps.Keys(catalog)); !slices.Equal(keys, expected) {
+			t.Fatalf("catalog %s does not have the same keys as %s", lang, fallbackLanguage)
+		}
+	}
+}
+
+func TestMatchLanguage(t *testing.T) {
+	cases := map[string]string{
+		"en":      "en",
+		"en-US":   "en",
+		"EN_gb":   "en",
+		"zh-CN":   "zh-CN",
+		"zh-hans": "zh-CN",
+		"zh":      "zh-CN",
+		" en ":    "en",
+		"fr":      "",
+		"":        "",
+	}
+	for code, expected := range cases {
+		if got := matchLanguage(code); got != expected {
+			t.Fatalf("matchLanguage(%q): expected %q, got %q", code, expected, got)
+		}
+	}
+	if got := resolveLanguage("fr", "", "en-US"); got != "en" {
+		t.Fatalf("expected the first available language, got %q", got)
+	}
+	if got := resolveLanguage("fr"); got != resolveLanguage() {
+		t.Fatalf("expected the default language, got %q", got)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	if got := tr("en", "api.rate_limited", "seconds", "3"); got != "Too many attempts, please try again in 3 seconds" {
+		t.Fatalf("unexpected text: %q", got)
+	}
+	if got := tr("fr", "web.confirm"); got != tr(resolveLanguage(), "web.confirm") {
+		t.Fatalf("expected unknown language to fall back, got %q", got)
+	}
+	if got := tr("en", "no.such.key"); got != "no.such.key" {
+		t.Fatalf("expected missing key to be returned as is, got %q", got)
+	}
+}
+
+func TestLoadExtraCatalogs(t *testing.T) {
+	old := catalogs
+	t.Cleanup(func() { catalogs = old })
+
+	extra := fstest.MapFS{
+		"en.json": {Data: []byte(`{"web.confirm": "Got it"}`)},
+		"fr.json": {Data: []byte(`{"web.confirm": "D'accord"}`)},
+	}
+	merged, err := loadCatalogs(extra, catalogs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalogs = merged
+	if tr("en", "web.confirm") != "Got it" || tr("en", "web.captcha_submit") != old["en"]["web.captcha_submit"] {
+		t.Fatal("expected extra catalog to override only the given messages")
+	}
+	if matchLanguage("fr-FR") != "fr" || tr("fr", "web.confirm") != "D'accord" {
+		t.Fatal("expected a new language to be added")
+	}
+	// 新语言缺少的消息使用默认语言
+	if tr("fr", "web.captcha_submit") != tr(resolveLanguage(), "web.captcha_submit") {
+		t.Fatal("expected missing messages to fall back to the default language")
+	}
+	if old["en"]["web.confirm"] == "Got it" {
+		t.Fatal("expected base catalogs not to be modified")
+	}
+
+	if _, err := loadCatalogs(fstest.MapFS{"bad.json": {Data: []byte(`[`)}}, catalogs); err == nil {
+		t.Fatal("expected invalid json to be rejected")
+	}
+}
+
+func TestWebMessages(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/messages", webMessages)
+	req := httptest.NewRequest(http.MethodGet, "/messages?lang=fr", nil)
+	req.Header.Set("Accept-Language", "fr-FR,en-US;q=0.8")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp struct {
+		Data struct {
+			Lang     string            `json:"lang"`
+			Messages map[string]string `json:"messages"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.Lang != "en" || resp.Data.Messages["web.confirm"] != "OK" {
+		t.Fatalf("unexpected messages: %+v", resp.Data)
+	}
+	if _, ok := resp.Data.Messages["api.no_token"]; ok {
+		t.Fatal("expected only web messages to be returned")
+	}
+}
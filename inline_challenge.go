@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/puzpuzpuz/xsync/v4"
+)
+
+const (
+	// verifyModeWebApp 只发送小程序链接，verifyModeInline 只使用按钮验证，
+	// verifyModeBoth 发送小程序链接，并允许无法打开小程序的用户改用按钮验证
+	verifyModeWebApp = "webapp"
+	verifyModeInline = "inline"
+	verifyModeBoth   = "both"
+
+	inlineChallengePrefix   = "dioinline:"
+	inlineChallengeStart    = "start"
+	inlineChallengeAttempts = 3
+	inlineChallengeChoices  = 6
+)
+
+// inlineChallengeItem 的 name 为消息 key
+type inlineChallengeItem struct {
+	emoji string
+	name  string
+}
+
+var inlineChallengeItems = []inlineChallengeItem{
+	{"🍎", "bot.item.apple"}, {"🍌", "bot.item.banana"}, {"🍇", "bot.item.grapes"}, {"🍉", "bot.item.watermelon"},
+	{"🍓", "bot.item.strawberry"}, {"🍑", "bot.item.peach"}, {"🍍", "bot.item.pineapple"}, {"🥝", "bot.item.kiwi"},
+	{"🍒", "bot.item.cherries"}, {"🍋", "bot.item.lemon"}, {"🥕", "bot.item.carrot"}, {"🌽", "bot.item.corn"},
+}
+
+// inlineChallenge 是一次按钮验证，每次选错都会重新打乱按钮，lang 为题目消息使用的语言
+type inlineChallenge struct {
+	mu           sync.Mutex
+	key          sessionKey
+	lang         string
+	answer       string
+	attemptsLeft int
+}
+
+var inlineChallenges = xsync.NewMap[sessionKey, *inlineChallenge]()
+
+func newInlineChallenge(key sessionKey, lang string) *inlineChallenge {
+	return &inlineChallenge{key: key, lang: lang, attemptsLeft: inlineChallengeAttempts}
+}
+
+// inlineCallbackData 生成按钮的回调数据，带上被验证的用户，
+// 群组中的提示消息所有人都能看到，其他人点击时不能替用户作答
+func inlineCallbackData(key sessionKey, choice string) string {
+	return fmt.Sprintf("%s%d:%d:%s", inlineChallengePrefix, key.ChatId, key.UserId, choice)
+}
+
+// parseInlineCallbackData 解析 inlineCallbackData 生成的回调数据
+func parseInlineCallbackData(data string) (sessionKey, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(data, inlineChallengePrefix), ":", 3)
+	if len(parts) != 3 {
+		return sessionKey{}, "", false
+	}
+	chatId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return sessionKey{}, "", false
+	}
+	userId, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return sessionKey{}, "", false
+	}
+	return sessionKey{UserId: userId, ChatId: chatId}, parts[2], true
+}
+
+// shuffle 重新生成题目与按钮，返回需要展示给用户的文本和键盘
+func (c *inlineChallenge) shuffle() (string, gotgbot.InlineKeyboardMarkup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items := make([]inlineChallengeItem, len(inlineChallengeItems))
+	copy(items, inlineChallengeItems)
+	mrand.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+	items = items[:inlineChallengeChoices]
+	target := mrand.IntN(len(items))
+
+	var rows [][]gotgbot.InlineKeyboardButton
+	var row []gotgbot.InlineKeyboardButton
+	for i, item := range items {
+		// 每个按钮使用随机的回调数据，避免通过按钮数据推断答案
+		token := rand.Text()[:8]
+		if i == target {
+			c.answer = token
+		}
+		row = append(row, gotgbot.InlineKeyboardButton{
+			Text:         item.emoji,
+			CallbackData: inlineCallbackData(c.key, token),
+		})
+		if len(row) == 3 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	text := tr(c.lang, "bot.inline_prompt", "item", tr(c.lang, items[target].name), "attempts", strconv.Itoa(c.attemptsLeft))
+	return text, gotgbot.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
+
+// attempt 校验用户的选择，返回是否正确以及剩余的机会
+func (c *inlineChallenge) attempt(choice string) (bool, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if choice == c.answer {
+		return true, c.attemptsLeft
+	}
+	c.attemptsLeft--
+	return false, c.attemptsLeft
+}
+
+// startInlineChallenge 为会话出题，已有题目时沿用它剩余的机会，只重新打乱按钮
+func startInlineChallenge(key sessionKey, lang string) (string, gotgbot.InlineKeyboardMarkup) {
+	c, _ := inlineChallenges.LoadOrStore(key, newInlineChallenge(key, lang))
+	return c.shuffle()
+}
+
+// sendVerificationPrompt 按群组配置的验证方式以 lang 向 targetChatId 发送验证提示，链接在 deadline 后失效
+func sendVerificationPrompt(bot *gotgbot.Bot, key sessionKey, data templateData, deadline time.Time, targetChatId int64, mode, lang string) error {
+	data = data.withDeadline(lang, deadline, time.Until(deadline)).withLink(verificationLink(bot.Username, key, deadline))
+	var text string
+	if targetChatId == key.ChatId {
+		// 链接入群时提示发在群组中，可以使用群组自定义的模板；入群申请的提示私聊发给用户，使用默认文本
+		text = groupMessageText(key.ChatId, lang, "prompt", data)
+	} else {
+		text = defaultMessageText(lang, "prompt", data)
+	}
+	opts := &gotgbot.SendMessageOpts{ParseMode: gotgbot.ParseModeHTML}
+	switch mode {
+	case verifyModeInline:
+		var markup gotgbot.InlineKeyboardMarkup
+		text, markup = startInlineChallenge(key, lang)
+		opts = &gotgbot.SendMessageOpts{ReplyMarkup: markup}
+	case verifyModeBoth:
+		text += "\n" + tr(lang, "bot.prompt_inline_hint")
+		opts.ReplyMarkup = gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{{
+			Text:         tr(lang, "bot.inline_switch"),
+			CallbackData: inlineCallbackData(key, inlineChallengeStart),
+		}}}}
+	}
+	_, err := bot.SendMessage(targetChatId, text, opts)
+	return err
+}
+
+func handleInlineChallengeCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	cq := ctx.CallbackQuery
+	lang := resolveLanguage(cq.From.LanguageCode)
+	key, choice, ok := parseInlineCallbackData(cq.Data)
+	if !ok || cq.Message == nil {
+		_, err := cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: tr(lang, "bot.inline_invalid_button")})
+		return err
+	}
+	if key.UserId != cq.From.Id {
+		_, err := cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: tr(lang, "bot.inline_not_yours")})
+		return err
+	}
+	event, ok := userStatus.Load(key)
+	if !ok || event.State() != userVerifying {
+		inlineChallenges.Delete(key)
+		_, err := cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: tr(lang, "bot.inline_no_session")})
+		return err
+	}
+	c, ok := inlineChallenges.Load(key)
+	if choice == inlineChallengeStart || !ok {
+		// 用户主动改用按钮验证，或者题目因重启等原因丢失，出题时沿用已有题目剩余的机会。
+		// 题目与提示消息在同一个聊天中，私聊时使用用户的语言，群组中使用群组的语言
+		if cq.Message.GetChat().Type != "private" {
+			lang = groupLanguage(key.ChatId)
+		}
+		text, markup := startInlineChallenge(key, lang)
+		if _, _, err := cq.Message.EditText(b, text, &gotgbot.EditMessageTextOpts{ReplyMarkup: markup}); err != nil {
+			return err
+		}
+		_, err := cq.Answer(b, nil)
+		return err
+	}
+
+	var err error
+	correct, attemptsLeft := c.attempt(choice)
+	switch {
+	case correct:
+		log.Printf("用户%d通过按钮验证", key.UserId)
+		inlineChallenges.Delete(key)
+		event.SetState(userVerifySucceed, StateChange{Trigger: TriggerInline})
+		if _, _, err := cq.Message.EditText(b, tr(c.lang, "bot.verify_succeeded"), nil); err != nil {
+			log.Printf("编辑按钮验证消息失败: %v", err)
+		}
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: tr(lang, "bot.verify_succeeded")})
+	case attemptsLeft <= 0:
+		log.Printf("用户%d按钮验证失败次数过多", key.UserId)
+		inlineChallenges.Delete(key)
+		event.SetState(userVerifyFailed, StateChange{Trigger: TriggerInline})
+		if _, _, err := cq.Message.EditText(b, tr(c.lang, "bot.verify_failed"), nil); err != nil {
+			log.Printf("编辑按钮验证消息失败: %v", err)
+		}
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: tr(lang, "bot.verify_failed")})
+	default:
+		text, markup := c.shuffle()
+		if _, _, err := cq.Message.EditText(b, text, &gotgbot.EditMessageTextOpts{ReplyMarkup: markup}); err != nil {
+			return err
+		}
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: tr(lang, "bot.inline_wrong", "attempts", strconv.Itoa(attemptsLeft))})
+	}
+	return err
+}
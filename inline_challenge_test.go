@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInlineChallengeShuffle(t *testing.T) {
+	c := newInlineChallenge(sessionKey{UserId: 42, ChatId: -100123}, "zh-CN")
+	text, markup := c.shuffle()
+	if !strings.Contains(text, "3次机会") {
+		t.Fatalf("unexpected challenge text: %s", text)
+	}
+	var buttons int
+	var found bool
+	for _, row := range markup.InlineKeyboard {
+		for _, button := range row {
+			buttons++
+			if !strings.HasPrefix(button.CallbackData, inlineChallengePrefix+"-100123:42:") {
+				t.Fatalf("unexpected callback data: %s", button.CallbackData)
+			}
+			if len(button.CallbackData) > 64 {
+				t.Fatalf("callback data exceeds telegram limit: %s", button.CallbackData)
+			}
+			if strings.HasSuffix(button.CallbackData, ":"+c.answer) {
+				found = true
+			}
+		}
+	}
+	if buttons != inlineChallengeChoices {
+		t.Fatalf("expected %d buttons, got %d", inlineChallengeChoices, buttons)
+	}
+	if !found {
+		t.Fatal("expected one button to carry the answer")
+	}
+}
+
+func TestInlineChallengeAttempts(t *testing.T) {
+	c := newInlineChallenge(sessionKey{UserId: 1, ChatId: 1}, "en")
+	c.shuffle()
+	for i := inlineChallengeAttempts - 1; i >= 0; i-- {
+		correct, left := c.attempt("wrong")
+		if correct || left != i {
+			t.Fatalf("expected wrong attempt with %d left, got correct=%v left=%d", i, correct, left)
+		}
+	}
+
+	c = newInlineChallenge(sessionKey{UserId: 1, ChatId: 1}, "en")
+	c.shuffle()
+	if correct, _ := c.attempt(c.answer); !correct {
+		t.Fatal("expected the answer to be accepted")
+	}
+}
+
+func TestInlineCallbackData(t *testing.T) {
+	key := sessionKey{UserId: 42, ChatId: -100123}
+	parsed, choice, ok := parseInlineCallbackData(inlineCallbackData(key, inlineChallengeStart))
+	if !ok || parsed != key || choice != inlineChallengeStart {
+		t.Fatalf("unexpected parse result: %+v %q %v", parsed, choice, ok)
+	}
+	for _, data := range []string{inlineChallengePrefix + "-100123:start", inlineChallengePrefix + "x:42:start", inlineChallengePrefix + "-100123:x:start"} {
+		if _, _, ok := parseInlineCallbackData(data); ok {
+			t.Fatalf("expected %q to be rejected", data)
+		}
+	}
+}
+
+func TestStartInlineChallengeKeepsAttempts(t *testing.T) {
+	key := sessionKey{UserId: 43, ChatId: -100123}
+	t.Cleanup(func() { inlineChallenges.Delete(key) })
+	startInlineChallenge(key, "en")
+	c, _ := inlineChallenges.Load(key)
+	c.attempt("wrong")
+
+	// 再次点击“改用按钮验证”不会重置机会
+	startInlineChallenge(key, "en")
+	again, _ := inlineChallenges.Load(key)
+	if again != c || again.attemptsLeft != inlineChallengeAttempts-1 {
+		t.Fatalf("expected the existing challenge to be kept, got %d attempts left", again.attemptsLeft)
+	}
+}
+
+func TestInlineChallengeClearedWhenSessionEnds(t *testing.T) {
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	key := sessionKey{UserId: 44, ChatId: -100123}
+	t.Cleanup(func() {
+		userStatus.Delete(key)
+		inlineChallenges.Delete(key)
+	})
+	event, _ := loadOrStartSession(key, "", DefaultGroupConfig(key.ChatId), TriggerJoinRequest)
+	startInlineChallenge(key, "en")
+	c, _ := inlineChallenges.Load(key)
+	c.attempt("wrong")
+
+	event.SetState(userVerifyFailed, StateChange{Trigger: TriggerTimeout})
+	if _, ok := inlineChallenges.Load(key); ok {
+		t.Fatal("expected the challenge to be removed when the session ends")
+	}
+	// 新的会话重新出题，机会不受上一个会话影响
+	loadOrStartSession(key, "", DefaultGroupConfig(key.ChatId), TriggerJoinRequest)
+	startInlineChallenge(key, "en")
+	if again, _ := inlineChallenges.Load(key); again == c || again.attemptsLeft != inlineChallengeAttempts {
+		t.Fatalf("expected a fresh challenge for the new session, got %d attempts left", again.attemptsLeft)
+	}
+}
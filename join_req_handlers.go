@@ -6,6 +6,8 @@ import (
 	"github.com/PaulSonOfLars/gotgbot/v2/ext"
 	"github.com/puzpuzpuz/xsync/v4"
 	"log"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -26,48 +28,133 @@ type UserJoinEvent struct {
 	deleteTimer       *time.Timer
 	verifyFailedTimer *time.Timer
 	UserId            int64
+	ChatId            int64
 	Username          string
 	ReqTime           time.Time
+	Deadline          time.Time
 	CurrentState      UserJoinState
+	// ShareVerification 来自群组配置，为真时用户为其他群组完成的验证也可以用于本会话
+	ShareVerification bool
+	onFinish          []func(UserJoinState)
+	// captchaMisses 为内置验证码答错的次数
+	captchaMisses int
+	// suspended 为真表示程序正在关闭，会话保持验证中，等待重启后从数据库恢复
+	suspended bool
 }
 
-func (u *UserJoinEvent) Init(userId int64, username string, verificationTimeout time.Duration) {
+// StateChange 描述一次状态变化的来源，会随状态一起写入验证记录
+type StateChange struct {
+	Trigger    VerificationTrigger
+	ErrorCodes []string
+	ClientIP   string
+}
+
+func (u *UserJoinEvent) Init(key sessionKey, username string, cfg GroupConfig, trigger VerificationTrigger) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	u.UserId = userId
+	u.init(key, username, cfg, trigger)
+}
+
+func (u *UserJoinEvent) init(key sessionKey, username string, cfg GroupConfig, trigger VerificationTrigger) {
+	now := time.Now()
+	u.arm(key, username, now, now.Add(cfg.VerificationTimeout()), cfg.ShareVerification, trigger)
+}
+
+// arm 设置会话并启动计时器，调用方需要持有 u.mu。
+// 恢复重启前的会话时 reqTime 与 deadline 来自数据库，截止时间已过的会立即判定为失败。
+func (u *UserJoinEvent) arm(key sessionKey, username string, reqTime, deadline time.Time, shareVerification bool, trigger VerificationTrigger) {
+	u.UserId = key.UserId
+	u.ChatId = key.ChatId
 	u.Username = username
-	u.ReqTime = time.Now()
+	u.ReqTime = reqTime
+	u.Deadline = deadline
+	u.ShareVerification = shareVerification
 	u.done = make(chan struct{})
-	u.deleteTimer = time.AfterFunc(time.Hour*12, func() {
-		// 状态最多保存12小时
-		userStatus.Delete(userId)
+	u.deleteTimer = time.AfterFunc(time.Until(reqTime.Add(time.Hour*12)), func() {
+		// 状态最多保存12小时，期间同一会话可能已被新的请求替换，只删除自己
+		userStatus.Compute(key, func(old *UserJoinEvent, loaded bool) (*UserJoinEvent, xsync.ComputeOp) {
+			if loaded && old == u {
+				return nil, xsync.DeleteOp
+			}
+			return old, xsync.CancelOp
+		})
 		u.o.Do(func() { close(u.done) })
 	})
-	timeout := verificationTimeout
-	if timeout <= 0 {
-		timeout = defaultVerificationTimeout
-	}
-	u.verifyFailedTimer = time.AfterFunc(timeout, func() {
-		u.SetState(userVerifyFailed)
+	u.verifyFailedTimer = time.AfterFunc(time.Until(deadline), func() {
+		u.SetState(userVerifyFailed, StateChange{Trigger: TriggerTimeout})
 	})
-	persistUserVerification(userId, username, userVerifying)
+	persistUserVerification(key, username, userVerifying)
+	// 持有锁时写入，保证已过期会话的超时记录排在开始记录之后
+	recordVerificationEvent(key, "", userVerifying, StateChange{Trigger: trigger})
+	publishSessionState(key, userVerifying)
 }
 
-func (u *UserJoinEvent) SetState(state UserJoinState) {
+// SetState 结束进行中的会话。会话只能结束一次，已经通过或失败的会话忽略之后的调用，
+// 避免迟到的提交、按钮回调或管理操作改写结果并重复执行结束后的处理
+func (u *UserJoinEvent) SetState(state UserJoinState, change StateChange) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	if state == u.CurrentState {
+	if u.suspended || u.CurrentState != userVerifying || state == userVerifying {
 		return
 	}
 	u.verifyFailedTimer.Stop()
+	old := u.CurrentState
 	u.CurrentState = state
-	persistUserVerification(u.UserId, u.Username, state)
+	persistUserVerification(sessionKey{UserId: u.UserId, ChatId: u.ChatId}, u.Username, state)
+	recordVerificationEvent(sessionKey{UserId: u.UserId, ChatId: u.ChatId}, statusOf(old), state, change)
+	observeSessionFinished(u, state, change)
+	publishSessionState(sessionKey{UserId: u.UserId, ChatId: u.ChatId}, state)
 	if state != userVerifying {
-		cleanupPendingGroups(u.UserId)
+		cleanupPendingGroup(u.UserId, u.ChatId)
+		// 按钮验证的题目只属于本会话，下一次入群请求需要重新出题
+		inlineChallenges.Delete(sessionKey{UserId: u.UserId, ChatId: u.ChatId})
+		for _, fn := range u.onFinish {
+			runOutcome(fn, state)
+		}
+		u.onFinish = nil
 	}
 	u.o.Do(func() { close(u.done) })
 }
 
+// OnFinish 注册会话通过或失败后执行的操作，会话已经结束时立即执行
+func (u *UserJoinEvent) OnFinish(fn func(UserJoinState)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.CurrentState != userVerifying {
+		runOutcome(fn, u.CurrentState)
+		return
+	}
+	u.onFinish = append(u.onFinish, fn)
+}
+
+// Suspend 在程序关闭时停止会话的计时器而不判定失败，返回会话是否仍在验证中
+func (u *UserJoinEvent) Suspend() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.suspended || u.CurrentState != userVerifying {
+		return false
+	}
+	u.suspended = true
+	u.verifyFailedTimer.Stop()
+	u.deleteTimer.Stop()
+	inlineChallenges.Delete(sessionKey{UserId: u.UserId, ChatId: u.ChatId})
+	return true
+}
+
+func (u *UserJoinEvent) State() UserJoinState {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.CurrentState
+}
+
+// MissCaptcha 记录一次内置验证码答错，返回剩余的机会
+func (u *UserJoinEvent) MissCaptcha() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.captchaMisses++
+	return captchaAttempts - u.captchaMisses
+}
+
 func (u *UserJoinEvent) UpdateUsername(username string) {
 	if username == "" {
 		return
@@ -93,12 +180,91 @@ func (u *UserJoinEvent) String() string {
 		state = "验证失败"
 	}
 	reqTime := u.ReqTime.Format("2006-01-02 15:04:05")
-	return fmt.Sprintf("user %d 于%s开始尝试加入，当前状态 [%s]，", u.UserId, reqTime, state)
+	return fmt.Sprintf("user %d 于%s开始尝试加入群组 %d，当前状态 [%s]，", u.UserId, reqTime, u.ChatId, state)
+}
+
+// sessionKey 与 pending_groups 的主键一致，每个用户在每个群组都有独立的验证会话
+type sessionKey struct {
+	UserId int64
+	ChatId int64
 }
 
-var userStatus = xsync.NewMap[int64, *UserJoinEvent]()
+var userStatus = xsync.NewMap[sessionKey, *UserJoinEvent]()
 
-const defaultVerificationTimeout = time.Minute * 6
+// outcomes 跟踪正在执行的会话结束操作（同意、拒绝、封禁等），关闭程序时等待它们完成
+var outcomes sync.WaitGroup
+
+func runOutcome(fn func(UserJoinState), state UserJoinState) {
+	outcomes.Add(1)
+	go func() {
+		defer outcomes.Done()
+		fn(state)
+	}()
+}
+
+// newLockedEvent 返回已经加锁的空会话，用于在 userStatus 的回调中占位。
+// 回调执行时持有 map 的锁，写数据库、推送状态等操作要在回调返回之后再做，
+// 期间其他请求取到该会话时会等待其初始化完成。
+func newLockedEvent() *UserJoinEvent {
+	e := &UserJoinEvent{}
+	e.mu.Lock()
+	return e
+}
+
+// loadOrStartSession 返回用户在该群组进行中的验证会话，没有或已经结束时开启新的会话。
+// started 为真表示会话是新开启的，调用方只在这种情况下发送验证提示并注册结束后的处理，
+// 否则重复的入群请求会让同一个会话执行多次同意、拒绝或封禁。
+// 入群申请与链接入群开启的会话同时写入待加入群组记录，用于重启后恢复。
+func loadOrStartSession(key sessionKey, username string, cfg GroupConfig, trigger VerificationTrigger) (event *UserJoinEvent, started bool) {
+	event, _ = userStatus.Compute(key, func(old *UserJoinEvent, loaded bool) (*UserJoinEvent, xsync.ComputeOp) {
+		if loaded && old.State() == userVerifying {
+			return old, xsync.CancelOp
+		}
+		started = true
+		return newLockedEvent(), xsync.UpdateOp
+	})
+	if started {
+		// 先写入记录再启动会话，会话很快结束时清理记录才不会早于写入，留下重启后被恢复的会话
+		now := time.Now()
+		deadline := now.Add(cfg.VerificationTimeout())
+		if source, ok := pendingSourceOf(trigger); ok {
+			if err := recordPendingGroup(key.UserId, key.ChatId, source, deadline); err != nil {
+				log.Printf("记录待加入群组失败: %v", err)
+			}
+		}
+		event.arm(key, username, now, deadline, cfg.ShareVerification, trigger)
+		event.mu.Unlock()
+		return event, true
+	}
+	event.UpdateUsername(username)
+	persistUserVerification(key, username, event.State())
+	return event, false
+}
+
+// sessionsSettledByPass 返回用户一次人类验证的结果可以作用到的会话：
+// 截止时间最早的会话，以及其余允许共用验证结果的群组的会话
+func sessionsSettledByPass(userId int64) []*UserJoinEvent {
+	var sessions []*UserJoinEvent
+	userStatus.Range(func(key sessionKey, e *UserJoinEvent) bool {
+		if key.UserId == userId && e.State() == userVerifying {
+			sessions = append(sessions, e)
+		}
+		return true
+	})
+	if len(sessions) == 0 {
+		return nil
+	}
+	slices.SortFunc(sessions, func(a, b *UserJoinEvent) int {
+		return a.Deadline.Compare(b.Deadline)
+	})
+	settled := []*UserJoinEvent{sessions[0]}
+	for _, e := range sessions[1:] {
+		if e.ShareVerification {
+			settled = append(settled, e)
+		}
+	}
+	return settled
+}
 
 func JoinRequestsHandler(bot *gotgbot.Bot, ctx *ext.Context) error {
 	req := ctx.ChatJoinRequest
@@ -106,49 +272,115 @@ func JoinRequestsHandler(bot *gotgbot.Bot, ctx *ext.Context) error {
 	if chatId == 0 {
 		return nil
 	}
-	verificationTimeout := defaultVerificationTimeout
-	if persistentStore != nil {
-		if cfg, err := persistentStore.GetOrCreateGroupConfig(req.Chat.Id); err == nil {
-			verificationTimeout = cfg.VerificationTimeout()
-		} else {
-			log.Printf("加载群组配置失败: %v", err)
+	key := sessionKey{UserId: req.From.Id, ChatId: req.Chat.Id}
+	metricJoinRequests.WithLabelValues(chatLabel(key.ChatId)).Inc()
+	if until := joinCooldownUntil(key); !until.IsZero() {
+		metricDeclines.WithLabelValues(chatLabel(key.ChatId)).Inc()
+		log.Printf("用户%d仍在群组%d的验证失败冷却期内，直到 %s", key.UserId, key.ChatId, until.Local().Format(time.DateTime))
+		if _, err := bot.DeclineChatJoinRequest(key.ChatId, key.UserId, nil); err != nil {
+			return err
 		}
+		recordVerificationEvent(key, "", userVerifyFailed, StateChange{Trigger: TriggerCooldown})
+		text := tr(resolveLanguage(req.From.LanguageCode), "bot.cooldown", "until", until.Local().Format(time.DateTime))
+		_, err := bot.SendMessage(req.UserChatId, text, nil)
+		return err
 	}
-	event, loaded := userStatus.LoadOrCompute(req.From.Id, func() (*UserJoinEvent, bool) {
-		e := &UserJoinEvent{}
-		e.Init(req.From.Id, req.From.Username, verificationTimeout)
-		return e, false
+	groupCfg := loadGroupConfig(req.Chat.Id)
+	event, started := loadOrStartSession(key, req.From.Username, groupCfg, TriggerJoinRequest)
+	if !started {
+		log.Printf("用户%d在群组%d已有进行中的验证，忽略重复的入群请求", key.UserId, key.ChatId)
+		return nil
+	}
+	event.OnFinish(func(state UserJoinState) {
+		applyJoinRequestOutcome(bot, req.Chat.Id, req.From.Id, state)
 	})
-	if loaded {
-		event.UpdateUsername(req.From.Username)
-		persistUserVerification(req.From.Id, req.From.Username, event.CurrentState)
+	log.Printf("向用户%d发送人类验证消息", req.From.Id)
+	data := newTemplateData(&req.From, req.Chat.Title)
+	return sendVerificationPrompt(bot, key, data, event.Deadline, req.UserChatId, groupCfg.VerifyMode, resolveLanguage(req.From.LanguageCode))
+}
+
+func applyJoinRequestOutcome(bot *gotgbot.Bot, chatId, userId int64, state UserJoinState) {
+	key := sessionKey{UserId: userId, ChatId: chatId}
+	switch state {
+	case userVerifying:
+		log.Printf("这里不该出现")
+	case userVerifySucceed:
+		log.Printf("尝试允许用户%d加入", userId)
+		metricApprovals.WithLabelValues(chatLabel(chatId)).Inc()
+		_, err := bot.ApproveChatJoinRequest(chatId, userId, nil)
+		if err != nil {
+			log.Printf("允许用户%d加入失败: %s", userId, err)
+		}
+		publishSessionOutcome(key, outcomeApproved, err)
+	case userVerifyFailed:
+		log.Printf("尝试拒绝用户%d加入", userId)
+		metricDeclines.WithLabelValues(chatLabel(chatId)).Inc()
+		_, err := bot.DeclineChatJoinRequest(chatId, userId, nil)
+		if err != nil {
+			log.Printf("拒绝用户%d加入失败: %s", userId, err)
+		}
+		publishSessionOutcome(key, outcomeDeclined, err)
+		recordJoinCooldown(key, time.Now().Add(loadGroupConfig(chatId).BanCooldown()))
 	}
-	if err := recordPendingGroup(req.From.Id, req.Chat.Id); err != nil {
-		log.Printf("记录待加入群组失败: %v", err)
+}
+
+// restorePendingVerifications 在启动时从数据库恢复重启前尚未完成的验证，
+// 重新挂上超时计时器与同意/拒绝的后续处理，已超时的请求会被立即拒绝。
+// 需要在开始接收更新之前调用。
+func restorePendingVerifications(bot *gotgbot.Bot) {
+	if persistentStore == nil {
+		return
 	}
-	text := fmt.Sprintf("点击下方链接验证您是人类\nhttps://t.me/%s?startapp", bot.Username)
-	log.Printf("向用户%d发送人类验证消息", req.From.Id)
-	_, err := bot.SendMessage(req.UserChatId, text, nil)
-	go func() {
-		newState := event.WaitForStateEvent()
-		switch newState {
-		case userVerifying:
-			log.Printf("这里不该出现")
-		case userVerifySucceed:
-			log.Printf("尝试允许用户%d加入", req.From.Id)
-			_, err := bot.ApproveChatJoinRequest(req.Chat.Id, req.From.Id, nil)
-			if err != nil {
-				log.Printf("允许用户%d加入失败: %s", req.From.Id, err)
-			}
-		case userVerifyFailed:
-			log.Printf("尝试拒绝用户%d加入", req.From.Id)
-			_, err := bot.DeclineChatJoinRequest(req.Chat.Id, req.From.Id, nil)
-			if err != nil {
-				log.Printf("拒绝用户%d加入失败: %s", req.From.Id, err)
-			}
+	pending, err := persistentStore.ListPendingVerifications()
+	if err != nil {
+		log.Printf("读取待验证记录失败: %v", err)
+		return
+	}
+	for _, p := range pending {
+		groupCfg := loadGroupConfig(p.ChatID)
+		deadline := p.Deadline
+		if deadline.IsZero() {
+			deadline = p.RequestedAt.Add(groupCfg.VerificationTimeout())
 		}
-	}()
-	return err
+		key := sessionKey{UserId: p.UserID, ChatId: p.ChatID}
+		var restored bool
+		event, _ := userStatus.LoadOrCompute(key, func() (*UserJoinEvent, bool) {
+			restored = true
+			return newLockedEvent(), false
+		})
+		if !restored {
+			continue
+		}
+		event.arm(key, p.Username, p.RequestedAt, deadline, groupCfg.ShareVerification, TriggerRestore)
+		event.mu.Unlock()
+		log.Printf("恢复用户%d在群组%d的验证，截止时间 %s", p.UserID, p.ChatID, deadline.Local().Format(time.DateTime))
+		event.OnFinish(func(state UserJoinState) {
+			switch p.Source {
+			case PendingSourceInviteLink:
+				finishLinkJoin(bot, key, state, func() (gotgbot.User, string) { return restoredMember(bot, key, p.Username) })
+			default:
+				applyJoinRequestOutcome(bot, p.ChatID, p.UserID, state)
+			}
+		})
+	}
+	log.Printf("从数据库恢复了%d条待验证记录", len(pending))
+}
+
+// restoredMember 查询恢复的会话的用户与群组名称，数据库中只保存了用户名，查询失败时使用它
+func restoredMember(bot *gotgbot.Bot, key sessionKey, username string) (gotgbot.User, string) {
+	user := gotgbot.User{Id: key.UserId, FirstName: username, Username: username}
+	if member, err := bot.GetChatMember(key.ChatId, key.UserId, nil); err == nil {
+		user = member.GetUser()
+	} else {
+		log.Printf("查询用户%d在群组%d的信息失败: %v", key.UserId, key.ChatId, err)
+	}
+	var group string
+	if chat, err := bot.GetChat(key.ChatId, nil); err == nil {
+		group = chat.Title
+	} else {
+		log.Printf("查询群组%d的信息失败: %v", key.ChatId, err)
+	}
+	return user, group
 }
 
 func getUserFullName(user *gotgbot.User) string {
@@ -161,36 +393,138 @@ func getUserFullName(user *gotgbot.User) string {
 	return buf.String()
 }
 
-func persistUserVerification(userID int64, username string, state UserJoinState) {
+// formatDuration 将时长格式化为“1天2小时3分钟”这样的描述，省略为零的单位
+func formatDuration(lang string, d time.Duration) string {
+	if d < time.Second {
+		return tr(lang, "duration.second", "n", "0")
+	}
+	units := []struct {
+		unit time.Duration
+		key  string
+	}{
+		{24 * time.Hour, "duration.day"},
+		{time.Hour, "duration.hour"},
+		{time.Minute, "duration.minute"},
+		{time.Second, "duration.second"},
+	}
+	var parts []string
+	for _, u := range units {
+		if n := d / u.unit; n > 0 {
+			parts = append(parts, tr(lang, u.key, "n", strconv.FormatInt(int64(n), 10)))
+			d -= n * u.unit
+		}
+	}
+	return strings.Join(parts, tr(lang, "duration.separator"))
+}
+
+func loadGroupConfig(chatId int64) GroupConfig {
+	if persistentStore != nil {
+		cfg, err := persistentStore.GetOrCreateGroupConfig(chatId)
+		if err == nil {
+			return cfg
+		}
+		log.Printf("加载群组配置失败: %v", err)
+	}
+	return DefaultGroupConfig(chatId)
+}
+
+func persistUserVerification(key sessionKey, username string, state UserJoinState) {
 	if persistentStore == nil {
 		return
 	}
-	var status VerificationStatus
+	if err := persistentStore.UpsertUserVerification(key.UserId, key.ChatId, username, statusOf(state)); err != nil {
+		log.Printf("写入用户验证状态失败: %v", err)
+	}
+}
+
+func statusOf(state UserJoinState) VerificationStatus {
 	switch state {
 	case userVerifySucceed:
-		status = StatusSuccess
+		return StatusSuccess
 	case userVerifyFailed:
-		status = StatusFailed
+		return StatusFailed
 	default:
-		status = StatusVerifying
+		return StatusVerifying
 	}
-	if err := persistentStore.UpsertUserVerification(userID, username, status); err != nil {
-		log.Printf("写入用户验证状态失败: %v", err)
+}
+
+// recordVerificationEvent 写入一条验证状态变化记录，oldStatus 为空表示新开始的会话
+func recordVerificationEvent(key sessionKey, oldStatus VerificationStatus, state UserJoinState, change StateChange) {
+	if persistentStore == nil {
+		return
+	}
+	err := persistentStore.AddVerificationEvent(VerificationEvent{
+		UserID:     key.UserId,
+		ChatID:     key.ChatId,
+		OldStatus:  oldStatus,
+		NewStatus:  statusOf(state),
+		Trigger:    change.Trigger,
+		ErrorCodes: change.ErrorCodes,
+		ClientIP:   change.ClientIP,
+	})
+	if err != nil {
+		log.Printf("写入验证记录失败: %v", err)
 	}
 }
 
-func cleanupPendingGroups(userID int64) {
+// suspendSessions 在程序关闭时挂起所有验证中的会话，并保存其截止时间以便重启后恢复
+func suspendSessions() {
+	userStatus.Range(func(key sessionKey, e *UserJoinEvent) bool {
+		if !e.Suspend() || persistentStore == nil {
+			return true
+		}
+		if err := persistentStore.SetPendingDeadline(key.UserId, key.ChatId, e.Deadline); err != nil {
+			log.Printf("保存用户%d在群组%d的验证截止时间失败: %v", key.UserId, key.ChatId, err)
+		}
+		return true
+	})
+}
+
+func cleanupPendingGroup(userID, chatID int64) {
 	if persistentStore == nil {
 		return
 	}
-	if err := persistentStore.DeletePendingGroupsByUser(userID); err != nil {
+	if err := persistentStore.DeletePendingGroup(userID, chatID); err != nil {
 		log.Printf("清理待加入群组失败: %v", err)
 	}
 }
 
-func recordPendingGroup(userID, chatID int64) error {
+// joinCooldownUntil 返回用户验证失败后不能再次申请的截止时间，不在冷却期内时返回零值
+func joinCooldownUntil(key sessionKey) time.Time {
+	if persistentStore == nil {
+		return time.Time{}
+	}
+	until, err := persistentStore.GetJoinCooldown(key.UserId, key.ChatId)
+	if err != nil {
+		log.Printf("读取入群冷却失败: %v", err)
+		return time.Time{}
+	}
+	return until
+}
+
+func recordJoinCooldown(key sessionKey, until time.Time) {
+	if persistentStore == nil {
+		return
+	}
+	if err := persistentStore.SetJoinCooldown(key.UserId, key.ChatId, until); err != nil {
+		log.Printf("写入入群冷却失败: %v", err)
+	}
+}
+
+// pendingSourceOf 返回需要在重启后恢复的会话的来源，测试模式等其他会话不需要恢复
+func pendingSourceOf(trigger VerificationTrigger) (PendingSource, bool) {
+	switch trigger {
+	case TriggerJoinRequest:
+		return PendingSourceJoinRequest, true
+	case TriggerInviteLink:
+		return PendingSourceInviteLink, true
+	}
+	return "", false
+}
+
+func recordPendingGroup(userID, chatID int64, source PendingSource, deadline time.Time) error {
 	if persistentStore == nil {
 		return nil
 	}
-	return persistentStore.AddPendingGroup(userID, chatID)
+	return persistentStore.AddPendingGroup(userID, chatID, source, deadline)
 }
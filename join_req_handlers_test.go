@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOnFinish(t *testing.T) {
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	key := sessionKey{UserId: 515151, ChatId: -100515151}
+	event := &UserJoinEvent{}
+	event.Init(key, "finish_test", DefaultGroupConfig(key.ChatId), TriggerJoinRequest)
+	results := make(chan UserJoinState, 1)
+	event.OnFinish(func(state UserJoinState) { results <- state })
+
+	event.SetState(userVerifySucceed, StateChange{Trigger: TriggerAdmin})
+	outcomes.Wait()
+	if len(results) != 1 || <-results != userVerifySucceed {
+		t.Fatal("expected OnFinish to run with the final state")
+	}
+
+	// 会话已经结束时注册的操作立即执行
+	event.OnFinish(func(state UserJoinState) { results <- state })
+	outcomes.Wait()
+	if len(results) != 1 || <-results != userVerifySucceed {
+		t.Fatal("expected OnFinish on a finished session to run immediately")
+	}
+}
+
+func TestSetStateIgnoresFinishedSession(t *testing.T) {
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	key := sessionKey{UserId: 555555, ChatId: -100555555}
+	event := &UserJoinEvent{}
+	event.Init(key, "terminal_test", DefaultGroupConfig(key.ChatId), TriggerJoinRequest)
+	var finished atomic.Int32
+	event.OnFinish(func(UserJoinState) { finished.Add(1) })
+
+	event.SetState(userVerifyFailed, StateChange{Trigger: TriggerTimeout})
+	// 迟到的通过与管理操作都不能改写已经失败的会话
+	event.SetState(userVerifySucceed, StateChange{Trigger: TriggerInline})
+	event.SetState(userVerifySucceed, StateChange{Trigger: TriggerAdmin})
+	outcomes.Wait()
+	if event.State() != userVerifyFailed || finished.Load() != 1 {
+		t.Fatalf("expected the session to stay failed with one outcome, got %v after %d outcomes", event.State(), finished.Load())
+	}
+	recorded, err := persistentStore.QueryVerificationEvents(VerificationEventFilter{UserID: key.UserId})
+	if err != nil || len(recorded) != 2 {
+		t.Fatalf("expected only the start and failure records, got %+v (err=%v)", recorded, err)
+	}
+}
+
+func TestSuspendSessions(t *testing.T) {
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	key := sessionKey{UserId: 525252, ChatId: -100525252}
+	event := &UserJoinEvent{}
+	event.Init(key, "suspend_test", DefaultGroupConfig(key.ChatId), TriggerJoinRequest)
+	userStatus.Store(key, event)
+	t.Cleanup(func() { userStatus.Delete(key) })
+	if err := persistentStore.AddPendingGroup(key.UserId, key.ChatId, PendingSourceJoinRequest, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("add pending group failed: %v", err)
+	}
+	finished := make(chan UserJoinState, 1)
+	event.OnFinish(func(state UserJoinState) { finished <- state })
+
+	suspendSessions()
+	// 超时计时器触发时同样调用 SetState，直接调用以免等待真实的超时
+	event.SetState(userVerifyFailed, StateChange{Trigger: TriggerTimeout})
+	event.SetState(userVerifySucceed, StateChange{Trigger: TriggerAdmin})
+	outcomes.Wait()
+	if event.State() != userVerifying || len(finished) != 0 {
+		t.Fatalf("expected suspended session to stay verifying, got %v", event.State())
+	}
+	pending, err := persistentStore.ListPendingVerifications()
+	if err != nil {
+		t.Fatalf("list pending failed: %v", err)
+	}
+	if len(pending) != 1 || !pending[0].Deadline.Equal(event.Deadline) {
+		t.Fatalf("expected pending deadline %v to be saved, got %+v", event.Deadline, pending)
+	}
+}
+
+func TestLoadOrStartSessionConcurrent(t *testing.T) {
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	key := sessionKey{UserId: 545454, ChatId: -100545454}
+	t.Cleanup(func() { userStatus.Delete(key) })
+	cfg := DefaultGroupConfig(key.ChatId)
+	events := make(chan *UserJoinEvent, 8)
+	var wg sync.WaitGroup
+	var starts atomic.Int32
+	for range cap(events) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			event, started := loadOrStartSession(key, "concurrent_test", cfg, TriggerJoinRequest)
+			if started {
+				starts.Add(1)
+			}
+			events <- event
+		}()
+	}
+	wg.Wait()
+	close(events)
+	first := <-events
+	for e := range events {
+		if e != first {
+			t.Fatal("expected concurrent requests to share one session")
+		}
+	}
+	// 只有一个请求会开启会话，其余的不应再注册结束后的处理
+	if starts.Load() != 1 {
+		t.Fatalf("expected exactly one request to start the session, got %d", starts.Load())
+	}
+	// 取到会话时它已经初始化完成
+	if first.Deadline.IsZero() || first.State() != userVerifying {
+		t.Fatalf("expected an initialized session, got %s", first)
+	}
+	recorded, err := persistentStore.QueryVerificationEvents(VerificationEventFilter{UserID: key.UserId})
+	if err != nil || len(recorded) != 1 {
+		t.Fatalf("expected exactly one start record, got %+v (err=%v)", recorded, err)
+	}
+}
+
+func TestLoadOrStartSessionRecordsPendingGroup(t *testing.T) {
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	key := sessionKey{UserId: 565656, ChatId: -100565656}
+	t.Cleanup(func() { userStatus.Delete(key) })
+	event, _ := loadOrStartSession(key, "pending_test", DefaultGroupConfig(key.ChatId), TriggerInviteLink)
+	pending, err := persistentStore.ListPendingVerifications()
+	if err != nil || len(pending) != 1 || pending[0].Source != PendingSourceInviteLink || !pending[0].Deadline.Equal(event.Deadline) {
+		t.Fatalf("expected the started session to be recorded, got %+v (err=%v)", pending, err)
+	}
+
+	// 会话结束后记录被清理，不会在重启后被恢复
+	event.SetState(userVerifySucceed, StateChange{Trigger: TriggerAdmin})
+	if pending, err := persistentStore.ListPendingVerifications(); err != nil || len(pending) != 0 {
+		t.Fatalf("expected no pending groups after the session ended, got %+v (err=%v)", pending, err)
+	}
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	"github.com/caarlos0/env/v11"
 	"github.com/puzpuzpuz/xsync/v4"
-	"html"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"reflect"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/callbackquery"
 )
 
 type config struct {
@@ -20,16 +26,51 @@ type config struct {
 	Testing  bool   `env:"TESTING" envDefault:"false" help:"测试用开关，打开后即使在浏览器打开也可以视同Telegram小程序"`
 	ApiAddr  string `env:"API_ADDR" envDefault:"https://api.telegram.org"`
 
+	InitDataPublicKey string        `env:"INIT_DATA_PUBLIC_KEY" envDefault:"" help:"Telegram 用于 initData signature 的 Ed25519 公钥（hex），配置后优先校验签名，生产与测试环境的公钥见 Telegram 文档"`
+	BotId             int64         `env:"BOT_ID" envDefault:"0" help:"校验 signature 时使用的 bot id，为0时从 BOT_TOKEN 中取得"`
+	InitDataMaxAge    time.Duration `env:"INIT_DATA_MAX_AGE" envDefault:"5m" help:"打开验证页面后提交验证的最长时间"`
+
 	DatabasePath string `env:"DATABASE_PATH" envDefault:"./data.sqlite" help:"SQLite 存储文件路径"`
 
 	ListenAddress string `env:"LISTEN_ADDR" envDefault:":8532" help:"监听地址"`
 	TlsCertPath   string `env:"TLS_CERT" envDefault:"" help:"TLS 证书文件，同时设置证书与密钥可启用TLS监听"`
 	TlsKeyPath    string `env:"TLS_KEY" envDefault:"" help:"TLS 密钥文件"`
 
+	WebhookURL    string `env:"WEBHOOK_URL" envDefault:"" help:"HTTP服务对外的根地址，设置后使用webhook接收更新而不是长轮询，例如 https://example.com"`
+	WebhookSecret string `env:"WEBHOOK_SECRET" envDefault:"" help:"webhook密钥，Telegram会通过X-Telegram-Bot-Api-Secret-Token头发送，未设置时随机生成" secret:"true"`
+
+	DefaultLanguage string `env:"DEFAULT_LANGUAGE" envDefault:"zh-CN" help:"默认语言，用户或群组的语言没有对应的消息目录时使用"`
+	LocalesDir      string `env:"LOCALES_DIR" envDefault:"" help:"额外的消息目录所在文件夹，其中的 <语言>.json 会覆盖内置文本或加入新的语言"`
+
+	AdminToken string `env:"ADMIN_TOKEN" envDefault:"" help:"管理接口 /admin/api 的 Bearer token，未设置时不启用管理接口" secret:"true"`
+
 	// 公开，请求时会发送给客户端
 	TurnstileSiteKey string `env:"TURNSTILE_SITE_KEY" envDefault:"" help:"Turnstile网站key，公开，需要发送给用户用于识别。"`
 	// 私有，只会存在服务器端
 	TurnstileSecret string `env:"TURNSTILE_SECRET" envDefault:"" help:"Turnstile密钥，私有，只会保存在后端程序中" secret:"true"`
+
+	TurnstileVerifyURL string `env:"TURNSTILE_VERIFY_URL" envDefault:"https://challenges.cloudflare.com/turnstile/v0/siteverify" help:"Turnstile siteverify 地址，可指向本地桩服务用于测试"`
+
+	ChallengeProvider  string `env:"CHALLENGE_PROVIDER" envDefault:"turnstile" help:"默认的人机验证服务，可选 turnstile、hcaptcha、recaptcha、builtin，群组可单独配置"`
+	HCaptchaSiteKey    string `env:"HCAPTCHA_SITE_KEY" envDefault:"" help:"hCaptcha网站key，与密钥同时配置后才可使用hCaptcha"`
+	HCaptchaSecret     string `env:"HCAPTCHA_SECRET" envDefault:"" help:"hCaptcha密钥" secret:"true"`
+	HCaptchaVerifyURL  string `env:"HCAPTCHA_VERIFY_URL" envDefault:"https://api.hcaptcha.com/siteverify" help:"hCaptcha siteverify 地址"`
+	ReCaptchaSiteKey   string `env:"RECAPTCHA_SITE_KEY" envDefault:"" help:"reCAPTCHA v2网站key，与密钥同时配置后才可使用reCAPTCHA"`
+	ReCaptchaSecret    string `env:"RECAPTCHA_SECRET" envDefault:"" help:"reCAPTCHA密钥" secret:"true"`
+	ReCaptchaVerifyURL string `env:"RECAPTCHA_VERIFY_URL" envDefault:"https://www.google.com/recaptcha/api/siteverify" help:"reCAPTCHA siteverify 地址"`
+
+	ChallengeHostnames []string      `env:"CHALLENGE_HOSTNAMES" envSeparator:"," help:"允许的验证页面主机名，逗号分隔，为空时不检查验证结果中的主机名"`
+	ChallengeMaxAge    time.Duration `env:"CHALLENGE_MAX_AGE" envDefault:"5m" help:"验证完成后提交 token 的最长时间"`
+
+	SiteVerifyTimeout time.Duration `env:"SITEVERIFY_TIMEOUT" envDefault:"5s" help:"单次请求 siteverify 的超时时间"`
+	SiteVerifyRetries int           `env:"SITEVERIFY_RETRIES" envDefault:"2" help:"Turnstile siteverify 遇到网络错误或5xx时的最多重试次数"`
+
+	TrustedProxies   []string `env:"TRUSTED_PROXIES" envDefault:"127.0.0.1,::1" envSeparator:"," help:"信任的反向代理地址或网段，来自这些地址的请求使用 CF-Connecting-IP 或 X-Forwarded-For 作为用户IP"`
+	VerifyUserRate   float64  `env:"VERIFY_USER_RATE" envDefault:"6" help:"每个用户每分钟可以提交验证的次数，0 表示不限制"`
+	VerifyUserBurst  int      `env:"VERIFY_USER_BURST" envDefault:"3" help:"每个用户可以连续提交验证的次数"`
+	VerifyIPRate     float64  `env:"VERIFY_IP_RATE" envDefault:"30" help:"每个IP每分钟可以提交验证的次数，0 表示不限制"`
+	VerifyIPBurst    int      `env:"VERIFY_IP_BURST" envDefault:"10" help:"每个IP可以连续提交验证的次数"`
+	RateLimitStrikes int      `env:"RATE_LIMIT_STRIKES" envDefault:"5" help:"用户提交验证被限流达到该次数后判定验证失败，0 表示不判定"`
 }
 
 var cfg config
@@ -85,24 +126,56 @@ func init() {
 		cfg.TurnstileSiteKey = "1x00000000000000000000AA"
 		cfg.TurnstileSecret = "1x0000000000000000000000000000000AA"
 	}
+	if cfg.LocalesDir != "" {
+		if err := loadExtraCatalogs(cfg.LocalesDir); err != nil {
+			log.Fatalf("加载消息目录 %s 失败: %v", cfg.LocalesDir, err)
+		}
+	}
+	if lang := matchLanguage(cfg.DefaultLanguage); lang != "" {
+		cfg.DefaultLanguage = lang
+	} else {
+		log.Fatalf("默认语言 %s 没有对应的消息目录，可选: %s", cfg.DefaultLanguage, strings.Join(availableLanguages(), ", "))
+	}
+	initDataAuth, err = newInitDataVerifier(cfg.BotToken, cfg.InitDataPublicKey, cfg.BotId)
+	if err != nil {
+		log.Fatalf("initData 校验配置错误: %v", err)
+	}
+	if len(cfg.ChallengeHostnames) == 0 {
+		log.Printf("\033[1;43;30mCHALLENGE_HOSTNAMES未配置，不会检查验证结果中的主机名，其他使用同一sitekey的网站上完成的验证也会被接受\033[0m")
+	}
+	if _, ok := challengeProviders()[cfg.ChallengeProvider]; !ok {
+		log.Fatalf("人机验证服务 %s 不存在或未配置密钥", cfg.ChallengeProvider)
+	}
+	if cfg.WebhookURL != "" && cfg.WebhookSecret == "" {
+		// 每次启动都会重新设置webhook，随机密钥不需要持久化
+		cfg.WebhookSecret = rand.Text()
+	}
 	printConfigHelp(cfg)
 }
 
+// webhookPath 为 webhook 在 HTTP 服务中的路径，完整地址为 WEBHOOK_URL + "/" + webhookPath
+const webhookPath = "telegram-webhook"
+
+// shutdownTimeout 为关闭时等待 HTTP 请求与同意/拒绝操作完成的最长时间
+const shutdownTimeout = 15 * time.Second
+
+var allowedUpdates = []string{"message", "my_chat_member", "chat_member", "chat_join_request", "callback_query"}
+
 // This bot is as basic as it gets - it simply repeats everything you say.
 // The main_test.go file contains example code to demonstrate how to implement the gotgbot.BotClient interface for it to be used in tests.
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	// Get token from the environment variable
-	go initHttp()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	// Create bot from environment value.
 	b, err := gotgbot.NewBot(cfg.BotToken, &gotgbot.BotOpts{
-		BotClient: &gotgbot.BaseBotClient{
+		BotClient: &instrumentedBotClient{BotClient: &gotgbot.BaseBotClient{
 			Client: http.Client{},
 			DefaultRequestOpts: &gotgbot.RequestOpts{
 				Timeout: 10 * time.Second, // Customise the default request timeout here
 				APIURL:  cfg.ApiAddr,      // As well as the Default API URL here (in case of using local bot API servers)
 			},
-		},
+		}},
 	})
 	if err != nil {
 		panic("failed to create new bot: " + err.Error())
@@ -123,26 +196,81 @@ func main() {
 	dispatcher.AddHandler(handlers.NewChatMember(isUserLeft, showGoodbyeMessageToChat))
 	dispatcher.AddHandler(handlers.NewChatMember(isUserBanned, showBannedMessageToChat))
 	dispatcher.AddHandler(handlers.NewChatMember(isUserJoinedByLink, showWelcomeMessageToUserJoinedByLink))
+	dispatcher.AddHandler(handlers.NewCommand("dioconfig", handleShowConfigCommand))
+	dispatcher.AddHandler(handlers.NewCommand("dioset", handleSetConfigCommand))
+	dispatcher.AddHandler(handlers.NewCommand("diotemplate", handleTemplateCommand))
 	dispatcher.AddHandler(handlers.NewMessage(isGroupMessage, handleAnyNewMsg))
 	dispatcher.AddHandler(handlers.NewChatJoinRequest(nil, JoinRequestsHandler))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix(inlineChallengePrefix), handleInlineChallengeCallback))
+	restorePendingVerifications(b)
 	// Start receiving updates.
-	err = updater.StartPolling(b, &ext.PollingOpts{
-		DropPendingUpdates: true,
-		GetUpdatesOpts: &gotgbot.GetUpdatesOpts{
-			Timeout:        9,
-			AllowedUpdates: []string{"message", "my_chat_member", "chat_member", "chat_join_request"},
-			RequestOpts: &gotgbot.RequestOpts{
-				Timeout: time.Second * 10,
+	var srv *http.Server
+	if cfg.WebhookURL != "" {
+		err = updater.AddWebhook(b, webhookPath, &ext.AddWebhookOpts{SecretToken: cfg.WebhookSecret})
+		if err != nil {
+			panic("failed to add webhook: " + err.Error())
+		}
+		// webhook 与验证页面共用同一个 HTTP 服务，需要先开始监听再向 Telegram 注册
+		srv = initHttp(b, updater)
+		err = updater.SetAllBotWebhooks(cfg.WebhookURL, &gotgbot.SetWebhookOpts{
+			AllowedUpdates:     allowedUpdates,
+			DropPendingUpdates: true,
+			SecretToken:        cfg.WebhookSecret,
+		})
+		if err != nil {
+			panic("failed to set webhook: " + err.Error())
+		}
+		log.Printf("%s has been started with webhook...\n", b.User.Username)
+	} else {
+		srv = initHttp(b, updater)
+		err = updater.StartPolling(b, &ext.PollingOpts{
+			DropPendingUpdates: true,
+			GetUpdatesOpts: &gotgbot.GetUpdatesOpts{
+				Timeout:        9,
+				AllowedUpdates: allowedUpdates,
+				RequestOpts: &gotgbot.RequestOpts{
+					Timeout: time.Second * 10,
+				},
 			},
-		},
-	})
-	if err != nil {
-		panic("failed to start polling: " + err.Error())
+		})
+		if err != nil {
+			panic("failed to start polling: " + err.Error())
+		}
+		log.Printf("%s has been started...\n", b.User.Username)
 	}
-	log.Printf("%s has been started...\n", b.User.Username)
 
-	// Idle, to keep updates coming in, and avoid bot stopping.
-	updater.Idle()
+	<-ctx.Done()
+	stop()
+	shutdown(srv, updater)
+}
+
+// shutdown 依次停止 HTTP 服务与接收更新、等待处理中的请求，然后挂起验证中的会话并关闭数据库。
+// 挂起的会话保留在 pending_groups 中，重启后由 restorePendingVerifications 恢复。
+func shutdown(srv *http.Server, updater *ext.Updater) {
+	log.Println("正在关闭...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("关闭HTTP服务失败: %v", err)
+	}
+	if err := updater.Stop(); err != nil {
+		log.Printf("停止接收更新失败: %v", err)
+	}
+	suspendSessions()
+	done := make(chan struct{})
+	go func() {
+		outcomes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("等待同意/拒绝操作超时")
+	}
+	if err := persistentStore.Close(); err != nil {
+		log.Printf("关闭数据库失败: %v", err)
+	}
+	log.Println("已关闭")
 }
 func isInvitedByOtherMember(u *gotgbot.ChatMemberUpdated) bool {
 	_, ok1 := u.OldChatMember.(gotgbot.ChatMemberLeft)
@@ -180,151 +308,177 @@ func isUserBanned(u *gotgbot.ChatMemberUpdated) bool {
 func showWelcomeMessageToUserViaInvited(b *gotgbot.Bot, ctx *ext.Context) error {
 	inviter := ctx.ChatMember.From
 	invitee := ctx.ChatMember.NewChatMember.GetUser()
-	text := fmt.Sprintf(`原来是%s先生请来的贵客，%s先生您也请。`, getUserFullName(&inviter), getUserFullName(&invitee))
-	_, err := b.SendMessage(ctx.ChatMember.Chat.Id, text, nil)
+	chat := ctx.ChatMember.Chat
+	data := newTemplateData(&invitee, chat.Title).withInviter(&inviter)
+	_, err := sendGroupMessage(b, chat.Id, groupLanguage(chat.Id), "welcome", data)
 	return err
 }
 
 func showWelcomeMessageToBotViaInvited(b *gotgbot.Bot, ctx *ext.Context) error {
 	inviter := ctx.ChatMember.From
 	invitee := ctx.ChatMember.NewChatMember.GetUser()
-	text := fmt.Sprintf(`原来是%s先生请来的打工bot %s，这里打工007的！`, getUserFullName(&inviter), getUserFullName(&invitee))
-	_, err := b.SendMessage(ctx.ChatMember.Chat.Id, text, nil)
+	chat := ctx.ChatMember.Chat
+	data := newTemplateData(&invitee, chat.Title).withInviter(&inviter)
+	_, err := sendGroupMessage(b, chat.Id, groupLanguage(chat.Id), "bot", data)
 	return err
 }
 
 func showGoodbyeMessageToChat(b *gotgbot.Bot, ctx *ext.Context) error {
 	leftUser := ctx.ChatMember.NewChatMember.GetUser()
-	text := fmt.Sprintf("%s先生好走！", getUserFullName(&leftUser))
-	_, err := b.SendMessage(ctx.ChatMember.Chat.Id, text, nil)
+	chat := ctx.ChatMember.Chat
+	_, err := sendGroupMessage(b, chat.Id, groupLanguage(chat.Id), "goodbye", newTemplateData(&leftUser, chat.Title))
 	return err
 }
 func showBannedMessageToChat(b *gotgbot.Bot, ctx *ext.Context) error {
 	bannedUser := ctx.ChatMember.NewChatMember.GetUser()
 	untilDate := ctx.ChatMember.NewChatMember.(gotgbot.ChatMemberBanned).UntilDate
-	log.Printf("untilDate = %d", untilDate)
-	var text string
+	var name string
 	until := time.Unix(untilDate, 0)
 	now := time.Now()
 	subTime := until.Sub(now)
 	subTime -= 10 * time.Second // 用于避免配置整单位时间时，传到bot时与telegram服务器的时间差
 	if untilDate == 0 {
-		text = fmt.Sprintf("%s被管理的大手处理，永远离开了我们", getUserFullName(&bannedUser))
+		name = "banned_forever"
 	} else if subTime < 900*time.Second {
-		text = fmt.Sprintf("%s被管理的大手处理，暂时离开了我们", getUserFullName(&bannedUser))
+		name = "banned_minutes"
 	} else if subTime < 16*time.Hour {
-		text = fmt.Sprintf("%s被管理的大手处理，离开了我们几个小时", getUserFullName(&bannedUser))
+		name = "banned_hours"
 	} else if subTime < 48*time.Hour {
-		text = fmt.Sprintf("%s被管理的大手处理，离开了我们一两天", getUserFullName(&bannedUser))
+		name = "banned_days"
 	} else if subTime < 7*24*time.Hour {
-		text = fmt.Sprintf("%s被管理的大手处理，要离开我们好几天", getUserFullName(&bannedUser))
+		name = "banned_week"
 	} else if subTime < 30*24*time.Hour {
-		text = fmt.Sprintf("%s被管理的大手处理，一个月内怕是见不到了", getUserFullName(&bannedUser))
+		name = "banned_month"
 	} else if subTime < 365*24*time.Hour {
-		text = fmt.Sprintf("%s被管理的大手处理，几个月都回不来，真是判得重了", getUserFullName(&bannedUser))
+		name = "banned_months"
 	} else {
-		text = fmt.Sprintf("%s被管理的大手处理，恐怕要等明年、后年，甚至下辈子才见得到了", getUserFullName(&bannedUser))
+		name = "banned_years"
+	}
+	chat := ctx.ChatMember.Chat
+	lang := groupLanguage(chat.Id)
+	data := newTemplateData(&bannedUser, chat.Title)
+	if untilDate != 0 {
+		// 封禁时长按分钟展示，忽略与 telegram 服务器的时间差
+		data = data.withDeadline(lang, until, until.Sub(now).Round(time.Minute))
 	}
 
-	_, err := b.SendMessage(ctx.ChatMember.Chat.Id, text, nil)
+	_, err := sendGroupMessage(b, chat.Id, lang, name, data)
 	return err
 }
 
-type newGroupUserKey struct {
-	UserId int64
-	ChatId int64
-}
 type newGroupUser struct {
 	until   time.Time
 	fn      *time.Timer
 	sentMsg *gotgbot.Message
 }
 
-var newGroupUsers = xsync.NewMap[newGroupUserKey, *newGroupUser]()
+var newGroupUsers = xsync.NewMap[sessionKey, *newGroupUser]()
 
 func showWelcomeMessageToUserJoinedByLink(b *gotgbot.Bot, ctx *ext.Context) error {
 	user := ctx.ChatMember.NewChatMember.GetUser()
-	key := newGroupUserKey{UserId: user.Id, ChatId: ctx.ChatMember.Chat.Id}
+	key := sessionKey{UserId: user.Id, ChatId: ctx.ChatMember.Chat.Id}
 	if !ctx.ChatMember.InviteLink.CreatesJoinRequest {
 		// 用户没有使用经过管理员同意的链接加入
+		metricLinkJoins.WithLabelValues(chatLabel(key.ChatId)).Inc()
 		_, err := b.RestrictChatMember(key.ChatId, key.UserId, gotgbot.ChatPermissions{}, nil)
 		if err != nil {
 			return err
 		}
-		verificationTimeout := defaultVerificationTimeout
-		if persistentStore != nil {
-			if cfg, err := persistentStore.GetOrCreateGroupConfig(key.ChatId); err == nil {
-				verificationTimeout = cfg.VerificationTimeout()
-			} else {
-				log.Printf("加载群组配置失败: %v", err)
-			}
+		groupCfg := loadGroupConfig(key.ChatId)
+		event, started := loadOrStartSession(key, user.Username, groupCfg, TriggerInviteLink)
+		if !started {
+			log.Printf("用户%d在群组%d已有进行中的验证，不再重复发送验证消息", key.UserId, key.ChatId)
+			return nil
 		}
-		event, loaded := userStatus.LoadOrCompute(key.UserId, func() (*UserJoinEvent, bool) {
-			e := &UserJoinEvent{}
-			e.Init(key.UserId, user.Username, verificationTimeout)
-			return e, false
+		// 在会话结束后处理，避免验证期间一直占用 dispatcher
+		event.OnFinish(func(state UserJoinState) {
+			finishLinkJoin(b, key, state, func() (gotgbot.User, string) { return user, ctx.ChatMember.Chat.Title })
 		})
-		if loaded {
-			event.UpdateUsername(user.Username)
-			persistUserVerification(key.UserId, user.Username, event.CurrentState)
-		}
-		if err := recordPendingGroup(key.UserId, key.ChatId); err != nil {
-			log.Printf("记录待加入群组失败: %v", err)
-		}
-		text := fmt.Sprintf("点击下方链接验证您是人类\nhttps://t.me/%s?startapp", b.Username)
 		log.Printf("向用户%d发送人类验证消息", key.ChatId)
-		_, err = b.SendMessage(key.ChatId, text, nil)
-		if err != nil {
-			return err
-		}
-		state := event.WaitForStateEvent()
-		switch state {
-		case userVerifyFailed:
-			_, err = b.BanChatMember(key.ChatId, key.UserId, nil)
-			return err
-		case userVerifying:
-			return nil
-		case userVerifySucceed:
-			_, err = b.RestrictChatMember(key.ChatId, key.UserId, gotgbot.ChatPermissions{
-				CanSendMessages:       true,
-				CanSendAudios:         true,
-				CanSendDocuments:      true,
-				CanSendPhotos:         true,
-				CanSendVideos:         true,
-				CanSendVideoNotes:     true,
-				CanSendVoiceNotes:     true,
-				CanSendPolls:          true,
-				CanSendOtherMessages:  true,
-				CanAddWebPagePreviews: true,
-				CanChangeInfo:         true,
-				CanInviteUsers:        true,
-				CanPinMessages:        true,
-				CanManageTopics:       true,
-			}, nil)
-		}
-		if err != nil {
-			return err
-		}
+		data := newTemplateData(&user, ctx.ChatMember.Chat.Title)
+		return sendVerificationPrompt(b, key, data, event.Deadline, key.ChatId, groupCfg.VerifyMode, resolveLanguage(groupCfg.Language))
 	}
-	until := time.Now().Add(10 * time.Minute)
-	value := &newGroupUser{fn: time.AfterFunc(time.Until(until), func() {
-		_, err := b.BanChatMember(key.ChatId, key.UserId, nil)
+	return requireFollowupMessage(b, key, user, ctx.ChatMember.Chat.Title)
+}
+
+// requireFollowupMessage 在群组开启入群发言要求时提示用户发言，宽限时间内没有发言会被移出群组
+func requireFollowupMessage(b *gotgbot.Bot, key sessionKey, user gotgbot.User, group string) error {
+	groupCfg := loadGroupConfig(key.ChatId)
+	if !groupCfg.RequireFollowupMessage {
+		return nil
+	}
+	grace := groupCfg.KickGracePeriod()
+	until := time.Now().Add(grace)
+	value := &newGroupUser{until: until, fn: time.AfterFunc(grace, func() {
+		newGroupUsers.Delete(key)
+		_, err := b.BanChatMember(key.ChatId, key.UserId, &gotgbot.BanChatMemberOpts{
+			UntilDate: time.Now().Add(loadGroupConfig(key.ChatId).BanCooldown()).Unix(),
+		})
 		if err != nil {
 			log.Println(err)
 		}
 	})}
 	newGroupUsers.Store(key, value)
 	time.Sleep(1 * time.Second)
-	text := fmt.Sprintf("欢迎<a href=\"%s\">%s</a>先生加入本群，和大家随便说点什么证明您是人类吧，否则bot还是会在10分钟后(%s)请您出去。",
-		fmt.Sprintf("tg://user?id=%d", key.UserId),
-		html.EscapeString(getUserFullName(&user)), until.Format(time.DateTime))
-	msg, err := b.SendMessage(ctx.ChatMember.Chat.Id, text, &gotgbot.SendMessageOpts{
-		ParseMode: gotgbot.ParseModeHTML,
-	})
+	lang := resolveLanguage(groupCfg.Language)
+	data := newTemplateData(&user, group).withDeadline(lang, until, grace)
+	msg, err := sendGroupMessage(b, key.ChatId, lang, "followup", data)
 	value.sentMsg = msg
 	return err
 }
 
+var fullChatPermissions = gotgbot.ChatPermissions{
+	CanSendMessages:       true,
+	CanSendAudios:         true,
+	CanSendDocuments:      true,
+	CanSendPhotos:         true,
+	CanSendVideos:         true,
+	CanSendVideoNotes:     true,
+	CanSendVoiceNotes:     true,
+	CanSendPolls:          true,
+	CanSendOtherMessages:  true,
+	CanAddWebPagePreviews: true,
+	CanChangeInfo:         true,
+	CanInviteUsers:        true,
+	CanPinMessages:        true,
+	CanManageTopics:       true,
+}
+
+// applyLinkJoinOutcome 处理通过链接直接入群的用户的验证结果：失败则按群组配置的冷却时间封禁，成功则解除禁言
+func applyLinkJoinOutcome(b *gotgbot.Bot, chatId, userId int64, state UserJoinState) error {
+	var err error
+	key := sessionKey{UserId: userId, ChatId: chatId}
+	switch state {
+	case userVerifyFailed:
+		metricDeclines.WithLabelValues(chatLabel(chatId)).Inc()
+		_, err = b.BanChatMember(chatId, userId, &gotgbot.BanChatMemberOpts{
+			UntilDate: time.Now().Add(loadGroupConfig(chatId).BanCooldown()).Unix(),
+		})
+		publishSessionOutcome(key, outcomeDeclined, err)
+	case userVerifySucceed:
+		metricApprovals.WithLabelValues(chatLabel(chatId)).Inc()
+		_, err = b.RestrictChatMember(chatId, userId, fullChatPermissions, nil)
+		publishSessionOutcome(key, outcomeApproved, err)
+	}
+	return err
+}
+
+// finishLinkJoin 是链接入群会话结束后的处理，新入群与重启后恢复的会话共用。
+// 验证通过后按群组配置要求用户发言，member 返回提示消息需要的用户与群组名称
+func finishLinkJoin(b *gotgbot.Bot, key sessionKey, state UserJoinState, member func() (gotgbot.User, string)) {
+	if err := applyLinkJoinOutcome(b, key.ChatId, key.UserId, state); err != nil {
+		log.Printf("处理用户%d在群组%d的验证结果失败: %v", key.UserId, key.ChatId, err)
+		return
+	}
+	if state != userVerifySucceed {
+		return
+	}
+	user, group := member()
+	if err := requireFollowupMessage(b, key, user, group); err != nil {
+		log.Printf("提示用户%d在群组%d发言失败: %v", key.UserId, key.ChatId, err)
+	}
+}
+
 func isGroupMessage(msg *gotgbot.Message) bool {
 	return msg.Chat.Type == "supergroup" || msg.Chat.Type == "group"
 }
@@ -335,16 +489,15 @@ func handleAnyNewMsg(b *gotgbot.Bot, ctx *ext.Context) error {
 	}
 	userId := ctx.EffectiveMessage.From.Id
 	chatId := ctx.EffectiveMessage.Chat.Id
-	key := newGroupUserKey{UserId: userId, ChatId: chatId}
+	key := sessionKey{UserId: userId, ChatId: chatId}
 	ngu, ok := newGroupUsers.Load(key)
 	if !ok {
 		return nil
 	}
 	defer newGroupUsers.Delete(key)
 	ngu.fn.Stop()
-	text := fmt.Sprintf("欢迎<a href=\"%s\">%s</a>先生加入本群！",
-		fmt.Sprintf("tg://user?id=%d", userId),
-		html.EscapeString(getUserFullName(ctx.EffectiveMessage.From)))
+	data := newTemplateData(ctx.EffectiveMessage.From, ctx.EffectiveMessage.Chat.Title)
+	text := groupMessageText(chatId, groupLanguage(chatId), "followup_done", data)
 	if ngu.sentMsg == nil {
 		return nil
 	}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// messageTemplate 是群组可以自定义的一种消息，没有自定义时使用语言目录中 defaultKey 的文本。
+// 自定义模板使用 text/template 语法，与默认文本一样以 HTML 格式发送。
+type messageTemplate struct {
+	name       string
+	defaultKey string
+}
+
+// messageTemplates 为 /diotemplate 可以修改的消息，按该顺序展示
+var messageTemplates = []messageTemplate{
+	{"welcome", "bot.welcome_invited"},
+	{"bot", "bot.welcome_bot"},
+	{"goodbye", "bot.goodbye"},
+	{"banned_forever", "bot.banned_forever"},
+	{"banned_minutes", "bot.banned_minutes"},
+	{"banned_hours", "bot.banned_hours"},
+	{"banned_days", "bot.banned_days"},
+	{"banned_week", "bot.banned_week"},
+	{"banned_month", "bot.banned_month"},
+	{"banned_months", "bot.banned_months"},
+	{"banned_years", "bot.banned_years"},
+	{"prompt", "bot.prompt"},
+	{"followup", "bot.followup"},
+	{"followup_done", "bot.followup_done"},
+}
+
+func findMessageTemplate(name string) (messageTemplate, bool) {
+	for _, tmpl := range messageTemplates {
+		if tmpl.name == strings.ToLower(name) {
+			return tmpl, true
+		}
+	}
+	return messageTemplate{}, false
+}
+
+func (t messageTemplate) desc(lang string) string {
+	return tr(lang, "template.desc."+t.name)
+}
+
+// templateData 为模板中可以使用的变量，来自用户的内容都已经按 HTML 转义。
+// 默认文本中对应的占位符见 placeholders。
+type templateData struct {
+	User           string
+	Mention        string
+	UserId         int64
+	Inviter        string
+	InviterMention string
+	Group          string
+	Deadline       string // 验证或发言的截止时间，封禁消息中为解封时间
+	Duration       string // 距离截止时间的时长
+	Link           string // 验证链接，只用于验证提示
+}
+
+func newTemplateData(user *gotgbot.User, group string) templateData {
+	return templateData{
+		User:    html.EscapeString(getUserFullName(user)),
+		Mention: userMention(user),
+		UserId:  user.Id,
+		Group:   html.EscapeString(group),
+	}
+}
+
+func (d templateData) withInviter(inviter *gotgbot.User) templateData {
+	d.Inviter = html.EscapeString(getUserFullName(inviter))
+	d.InviterMention = userMention(inviter)
+	return d
+}
+
+// withDeadline 设置截止时间，remaining 一般由 time.Until 得到，按秒四舍五入避免显示为少一秒
+func (d templateData) withDeadline(lang string, deadline time.Time, remaining time.Duration) templateData {
+	d.Deadline = deadline.Format(time.DateTime)
+	d.Duration = formatDuration(lang, remaining.Round(time.Second))
+	return d
+}
+
+func (d templateData) withLink(link string) templateData {
+	d.Link = html.EscapeString(link)
+	return d
+}
+
+func (d templateData) placeholders() []string {
+	return []string{
+		"user", d.User,
+		"mention", d.Mention,
+		"user_id", strconv.FormatInt(d.UserId, 10),
+		"inviter", d.Inviter,
+		"inviter_mention", d.InviterMention,
+		"group", d.Group,
+		"deadline", d.Deadline,
+		"duration", d.Duration,
+		"link", d.Link,
+	}
+}
+
+func userMention(user *gotgbot.User) string {
+	return fmt.Sprintf(`<a href="tg://user?id=%d">%s</a>`, user.Id, html.EscapeString(getUserFullName(user)))
+}
+
+var errEmptyTemplate = errors.New("template renders an empty message")
+
+// renderMessageTemplate 解析并渲染自定义模板，Telegram 不允许发送空消息，渲染结果为空同样视为错误
+func renderMessageTemplate(name, text string, data templateData) (string, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buf := strings.Builder{}
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(buf.String()) == "" {
+		return "", errEmptyTemplate
+	}
+	return buf.String(), nil
+}
+
+// defaultMessageText 返回 lang 中 name 消息的默认文本
+func defaultMessageText(lang, name string, data templateData) string {
+	tmpl, ok := findMessageTemplate(name)
+	if !ok {
+		return name
+	}
+	return tr(lang, tmpl.defaultKey, data.placeholders()...)
+}
+
+// groupMessageText 返回群组的 name 消息，群组自定义了模板时使用模板，
+// 没有自定义或模板无法渲染时使用 lang 的默认文本
+func groupMessageText(chatId int64, lang, name string, data templateData) string {
+	if persistentStore != nil {
+		text, ok, err := persistentStore.GetGroupTemplate(chatId, name)
+		if err != nil {
+			log.Printf("加载群组%d的消息模板 %s 失败: %v", chatId, name, err)
+		}
+		if ok {
+			rendered, err := renderMessageTemplate(name, text, data)
+			if err == nil {
+				return rendered
+			}
+			log.Printf("渲染群组%d的消息模板 %s 失败: %v", chatId, name, err)
+		}
+	}
+	return defaultMessageText(lang, name, data)
+}
+
+// sendGroupMessage 向群组发送 name 消息
+func sendGroupMessage(b *gotgbot.Bot, chatId int64, lang, name string, data templateData) (*gotgbot.Message, error) {
+	text := groupMessageText(chatId, lang, name, data)
+	return b.SendMessage(chatId, text, &gotgbot.SendMessageOpts{ParseMode: gotgbot.ParseModeHTML})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+func TestMessageTemplatesHaveCatalogEntries(t *testing.T) {
+	for _, tmpl := range messageTemplates {
+		for _, key := range []string{tmpl.defaultKey, "template.desc." + tmpl.name} {
+			if _, ok := catalogs[fallbackLanguage][key]; !ok {
+				t.Fatalf("template %s: missing message %s", tmpl.name, key)
+			}
+		}
+	}
+}
+
+func TestRenderMessageTemplate(t *testing.T) {
+	user := gotgbot.User{Id: 42, FirstName: "<b>Eve</b>"}
+	inviter := gotgbot.User{Id: 7, FirstName: "Bob"}
+	data := newTemplateData(&user, "A & B").withInviter(&inviter).
+		withDeadline("en", time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local), 90*time.Second)
+
+	got, err := renderMessageTemplate("welcome", "{{.Mention}} by {{.Inviter}} in {{.Group}}, {{.Duration}} until {{.Deadline}}", data)
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	expected := `<a href="tg://user?id=42">&lt;b&gt;Eve&lt;/b&gt;</a> by Bob in A &amp; B, 1m 30s until 2024-01-02 03:04:05`
+	if got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+
+	for _, bad := range []string{"{{.User", "{{.NoSuchField}}", "{{if false}}x{{end}}  "} {
+		if _, err := renderMessageTemplate("welcome", bad, data); err == nil {
+			t.Fatalf("expected template %q to fail", bad)
+		}
+	}
+}
+
+func TestGroupMessageText(t *testing.T) {
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	const chatId = -100777
+	user := gotgbot.User{Id: 42, FirstName: "Eve"}
+	data := newTemplateData(&user, "Group")
+
+	if got := groupMessageText(chatId, "en", "goodbye", data); got != "Farewell, Eve!" {
+		t.Fatalf("expected the default text, got %q", got)
+	}
+	if got := groupMessageText(chatId, "en", "followup_done", data); !strings.Contains(got, data.Mention) {
+		t.Fatalf("expected the default text to mention the user, got %q", got)
+	}
+
+	if err := persistentStore.SetGroupTemplate(chatId, "goodbye", "Bye {{.User}} from {{.Group}}"); err != nil {
+		t.Fatal(err)
+	}
+	if got := groupMessageText(chatId, "en", "goodbye", data); got != "Bye Eve from Group" {
+		t.Fatalf("expected the custom template, got %q", got)
+	}
+	if got := groupMessageText(chatId+1, "en", "goodbye", data); got != "Farewell, Eve!" {
+		t.Fatalf("expected other groups to keep the default, got %q", got)
+	}
+
+	// 模板无法渲染时使用默认文本
+	if err := persistentStore.SetGroupTemplate(chatId, "goodbye", "{{.Missing}}"); err != nil {
+		t.Fatal(err)
+	}
+	if got := groupMessageText(chatId, "en", "goodbye", data); got != "Farewell, Eve!" {
+		t.Fatalf("expected fallback to the default text, got %q", got)
+	}
+}
+
+func TestCutCommandArg(t *testing.T) {
+	action, rest := cutCommandArg("/diotemplate  set welcome Hi {{.Mention}}\nline two")
+	if action != "/diotemplate" {
+		t.Fatalf("unexpected command %q", action)
+	}
+	action, rest = cutCommandArg(rest)
+	name, text := cutCommandArg(rest)
+	if action != "set" || name != "welcome" || text != "Hi {{.Mention}}\nline two" {
+		t.Fatalf("unexpected args %q %q %q", action, name, text)
+	}
+	if arg, rest := cutCommandArg("  "); arg != "" || rest != "" {
+		t.Fatalf("expected empty args, got %q %q", arg, rest)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 群组数量有限，计数器按群组区分；错误码与接口名也是有限集合。
+// 直方图不按群组区分，避免每个群组都产生一整组桶。
+var (
+	metricJoinRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dio_join_requests_total",
+		Help: "收到的入群申请数量",
+	}, []string{"chat"})
+	metricLinkJoins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dio_link_joins_total",
+		Help: "通过不需要审核的链接直接入群、需要验证的用户数量",
+	}, []string{"chat"})
+	metricApprovals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dio_approvals_total",
+		Help: "验证通过后同意入群或解除禁言的次数",
+	}, []string{"chat"})
+	metricDeclines = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dio_declines_total",
+		Help: "验证失败或处于冷却期而拒绝入群或封禁的次数",
+	}, []string{"chat"})
+	metricTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dio_verification_timeouts_total",
+		Help: "超时未完成验证的会话数量",
+	}, []string{"chat"})
+	metricChallengeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dio_challenge_failures_total",
+		Help: "人机验证服务判定失败的次数，按验证服务与错误码区分",
+	}, []string{"provider", "error_code"})
+	metricRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dio_verify_rate_limited_total",
+		Help: "提交验证被限流的次数，按限流依据（user、ip）区分",
+	}, []string{"by"})
+	metricTelegramErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dio_telegram_api_errors_total",
+		Help: "调用 Telegram Bot API 失败的次数，按接口区分",
+	}, []string{"method"})
+	metricTimeToVerify = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dio_time_to_verify_seconds",
+		Help:    "从开始验证到验证结束的时长",
+		Buckets: []float64{5, 10, 20, 30, 60, 120, 180, 300, 600, 1800, 3600},
+	}, []string{"result"})
+	metricSiteVerifyLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dio_siteverify_duration_seconds",
+		Help:    "请求人机验证服务 siteverify 接口的耗时",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dio_user_sessions",
+		Help: "内存中的验证会话数量，包括已经结束但尚未清理的会话",
+	}, func() float64 { return float64(userStatus.Size()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dio_new_group_users",
+		Help: "链接入群后等待发言的用户数量",
+	}, func() float64 { return float64(newGroupUsers.Size()) })
+}
+
+func chatLabel(chatId int64) string {
+	return strconv.FormatInt(chatId, 10)
+}
+
+// observeSessionFinished 在会话结束时记录验证时长，超时另外计数
+func observeSessionFinished(u *UserJoinEvent, state UserJoinState, change StateChange) {
+	if state == userVerifying {
+		return
+	}
+	metricTimeToVerify.WithLabelValues(string(statusOf(state))).Observe(time.Since(u.ReqTime).Seconds())
+	if change.Trigger == TriggerTimeout {
+		metricTimeouts.WithLabelValues(chatLabel(u.ChatId)).Inc()
+	}
+}
+
+func observeChallengeFailure(provider string, errorCodes []string) {
+	if len(errorCodes) == 0 {
+		metricChallengeFailures.WithLabelValues(provider, "none").Inc()
+		return
+	}
+	for _, code := range errorCodes {
+		metricChallengeFailures.WithLabelValues(provider, code).Inc()
+	}
+}
+
+// instrumentedBotClient 统计每个 Bot API 接口的失败次数，并记录 getUpdates 最近一次成功的时间
+type instrumentedBotClient struct {
+	gotgbot.BotClient
+}
+
+func (c *instrumentedBotClient) RequestWithContext(ctx context.Context, token string, method string, params map[string]string, data map[string]gotgbot.FileReader, opts *gotgbot.RequestOpts) (json.RawMessage, error) {
+	resp, err := c.BotClient.RequestWithContext(ctx, token, method, params, data, opts)
+	if err != nil {
+		metricTelegramErrors.WithLabelValues(method).Inc()
+	} else if method == "getUpdates" {
+		lastGetUpdatesSuccess.Store(time.Now().UnixNano())
+	}
+	return resp, err
+}
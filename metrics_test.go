@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type failingBotClient struct {
+	gotgbot.BaseBotClient
+}
+
+func (c *failingBotClient) RequestWithContext(context.Context, string, string, map[string]string, map[string]gotgbot.FileReader, *gotgbot.RequestOpts) (json.RawMessage, error) {
+	return nil, errors.New("boom")
+}
+
+func TestInstrumentedBotClientCountsErrors(t *testing.T) {
+	client := &instrumentedBotClient{BotClient: &failingBotClient{}}
+	before := testutil.ToFloat64(metricTelegramErrors.WithLabelValues("approveChatJoinRequest"))
+	if _, err := client.RequestWithContext(context.Background(), "", "approveChatJoinRequest", nil, nil, nil); err == nil {
+		t.Fatal("expected error to be passed through")
+	}
+	if got := testutil.ToFloat64(metricTelegramErrors.WithLabelValues("approveChatJoinRequest")); got != before+1 {
+		t.Fatalf("expected error counter to increase by 1, got %v -> %v", before, got)
+	}
+}
+
+func TestObserveChallengeFailure(t *testing.T) {
+	codes := []string{"invalid-input-response", "timeout-or-duplicate", "none"}
+	before := make(map[string]float64)
+	for _, code := range codes {
+		before[code] = testutil.ToFloat64(metricChallengeFailures.WithLabelValues("test-provider", code))
+	}
+	observeChallengeFailure("test-provider", []string{"invalid-input-response", "timeout-or-duplicate"})
+	observeChallengeFailure("test-provider", nil)
+	for _, code := range codes {
+		if got := testutil.ToFloat64(metricChallengeFailures.WithLabelValues("test-provider", code)); got != before[code]+1 {
+			t.Fatalf("expected %s to increase by 1, got %v -> %v", code, before[code], got)
+		}
+	}
+}
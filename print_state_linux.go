@@ -10,12 +10,12 @@ import (
 )
 
 func init() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGUSR1)
 	go func() {
 		for _ = range c {
 			fmt.Println("当前用户状态")
-			userStatus.Range(func(_ int64, v *UserJoinEvent) bool {
+			userStatus.Range(func(_ sessionKey, v *UserJoinEvent) bool {
 				fmt.Printf("  %s", v.String())
 				return true
 			})
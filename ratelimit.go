@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/puzpuzpuz/xsync/v4"
+)
+
+const (
+	// rateLimitIdle 为令牌桶闲置后被清理的最短时间，被限流的次数也会随之清零
+	rateLimitIdle = 10 * time.Minute
+	// rateLimitPruneEvery 为两次清理闲置令牌桶之间的请求数，避免每个请求都遍历所有令牌桶
+	rateLimitPruneEvery = 256
+)
+
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	strikes int
+}
+
+// rateLimiter 是按 key 区分的令牌桶，每分钟补充 perMinute 个令牌，最多积攒 burst 个
+type rateLimiter struct {
+	rate    float64 // 每秒补充的令牌数
+	burst   float64
+	idle    time.Duration
+	buckets *xsync.Map[string, tokenBucket]
+	calls   atomic.Uint64
+}
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	l := &rateLimiter{rate: perMinute / 60, burst: math.Max(float64(burst), 1), idle: rateLimitIdle, buckets: xsync.NewMap[string, tokenBucket]()}
+	if l.rate > 0 {
+		// 闲置到令牌补满之前清理会让用户多得到令牌
+		l.idle = max(l.idle, time.Duration(l.burst/l.rate*float64(time.Second)))
+	}
+	return l
+}
+
+// prune 每 rateLimitPruneEvery 次请求清理一次闲置的令牌桶，
+// 期间还没有被清理的闲置令牌桶在下次使用时按新的令牌桶处理
+func (l *rateLimiter) prune(now time.Time) {
+	if l.calls.Add(1)%rateLimitPruneEvery != 0 {
+		return
+	}
+	l.buckets.Range(func(key string, b tokenBucket) bool {
+		if now.Sub(b.last) > l.idle {
+			l.buckets.Delete(key)
+		}
+		return true
+	})
+}
+
+func (l *rateLimiter) idleAt(b tokenBucket, now time.Time) bool {
+	return now.Sub(b.last) > l.idle
+}
+
+// take 消耗一个令牌，令牌不足时返回需要等待的时间，返回0表示允许
+func (l *rateLimiter) take(key string, now time.Time) (retryAfter time.Duration) {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.prune(now)
+	l.buckets.Compute(key, func(b tokenBucket, loaded bool) (tokenBucket, xsync.ComputeOp) {
+		if !loaded || l.idleAt(b, now) {
+			b = tokenBucket{tokens: l.burst}
+		} else {
+			b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+		} else {
+			retryAfter = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		}
+		return b, xsync.UpdateOp
+	})
+	return
+}
+
+// strike 记录一次被限流，返回闲置清理前累计的次数
+func (l *rateLimiter) strike(key string, now time.Time) (strikes int) {
+	l.buckets.Compute(key, func(b tokenBucket, loaded bool) (tokenBucket, xsync.ComputeOp) {
+		if !loaded || l.idleAt(b, now) {
+			b = tokenBucket{tokens: l.burst}
+		}
+		b.last = now
+		b.strikes++
+		strikes = b.strikes
+		return b, xsync.UpdateOp
+	})
+	return
+}
+
+// rateLimitVerify 按用户与IP限制提交验证的频率，需要放在 verifyHeader 之后。
+// 只有按用户限流的次数记在用户上，同一出口IP后的其他用户不会连累到他；
+// 达到 RateLimitStrikes 时判定本次验证所属的会话失败，与验证失败的处理一致。
+func rateLimitVerify(users, ips *rateLimiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		auth := ctx.MustGet("auth").(AuthInfo)
+		ip := ctx.ClientIP()
+		userKey := strconv.FormatInt(auth.User.Id, 10)
+		now := time.Now()
+		limitBy := "user"
+		retryAfter := users.take(userKey, now)
+		if retryAfter == 0 {
+			limitBy, retryAfter = "ip", ips.take(ip, now)
+		}
+		if retryAfter == 0 {
+			ctx.Next()
+			return
+		}
+		metricRateLimited.WithLabelValues(limitBy).Inc()
+		if limitBy == "user" {
+			strikes := users.strike(userKey, now)
+			log.Printf("[rateLimitVerify] 用户 %d (%s) 提交过于频繁，按user限流，累计 %d 次", auth.User.Id, ip, strikes)
+			if cfg.RateLimitStrikes > 0 && strikes >= cfg.RateLimitStrikes {
+				if event := ownSession(auth); event != nil {
+					event.SetState(userVerifyFailed, StateChange{Trigger: TriggerRateLimit, ErrorCodes: []string{"rate-limited"}, ClientIP: ip})
+				}
+			}
+		} else {
+			log.Printf("[rateLimitVerify] 用户 %d (%s) 提交过于频繁，按ip限流", auth.User.Id, ip)
+		}
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(seconds))
+		ctx.AbortWithStatusJSON(http.StatusTooManyRequests, hErrT(ctx, "api.rate_limited", "seconds", strconv.Itoa(seconds)))
+	}
+}
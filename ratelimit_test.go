@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(60, 2)
+	now := time.Now()
+	if l.take("a", now) != 0 || l.take("a", now) != 0 {
+		t.Fatal("expected burst to be allowed")
+	}
+	if wait := l.take("a", now); wait <= 0 || wait > time.Second {
+		t.Fatalf("expected to wait at most 1s, got %s", wait)
+	}
+	if l.take("b", now) != 0 {
+		t.Fatal("expected keys to be limited separately")
+	}
+	if l.take("a", now.Add(time.Second)) != 0 {
+		t.Fatal("expected a token to be refilled after 1s")
+	}
+
+	if newRateLimiter(0, 0).take("a", now) != 0 {
+		t.Fatal("expected zero rate to disable limiting")
+	}
+
+	// 闲置的令牌桶即使还没有被清理，再次使用时也会补满令牌并清零限流次数
+	l.strike("a", now)
+	if l.take("a", now.Add(l.idle+time.Minute)) != 0 || l.strike("a", now.Add(l.idle+time.Minute)) != 1 {
+		t.Fatal("expected an idle bucket to start over")
+	}
+}
+
+func TestRateLimitVerify(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldStore, oldStrikes := persistentStore, cfg.RateLimitStrikes
+	persistentStore = newTestStore(t)
+	cfg.RateLimitStrikes = 2
+	t.Cleanup(func() { persistentStore, cfg.RateLimitStrikes = oldStore, oldStrikes })
+
+	key := sessionKey{UserId: 535353, ChatId: -100535353}
+	event := &UserJoinEvent{}
+	event.Init(key, "rate_limit_test", DefaultGroupConfig(key.ChatId), TriggerJoinRequest)
+	userStatus.Store(key, event)
+	t.Cleanup(func() { userStatus.Delete(key) })
+
+	r := gin.New()
+	r.POST("/verify", func(ctx *gin.Context) {
+		ctx.Set("auth", AuthInfo{User: WebInitUser{Id: key.UserId}})
+	}, rateLimitVerify(newRateLimiter(1, 1), newRateLimiter(0, 0)), func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+	})
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verify", nil))
+		return w
+	}
+
+	if w := post(); w.Code != http.StatusOK {
+		t.Fatalf("expected first request to pass, got %d", w.Code)
+	}
+	w := post()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+	if event.State() != userVerifying {
+		t.Fatal("expected a single limit hit not to fail the session")
+	}
+	post()
+	if event.State() != userVerifyFailed {
+		t.Fatal("expected repeated limit hits to fail the session")
+	}
+	events, err := persistentStore.QueryVerificationEvents(VerificationEventFilter{UserID: key.UserId})
+	if err != nil || len(events) == 0 || events[0].Trigger != TriggerRateLimit {
+		t.Fatalf("expected a rate_limit event, got %+v (err=%v)", events, err)
+	}
+}
+
+func TestRateLimitVerifyScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldStore, oldStrikes := persistentStore, cfg.RateLimitStrikes
+	persistentStore = newTestStore(t)
+	cfg.RateLimitStrikes = 1
+	t.Cleanup(func() { persistentStore, cfg.RateLimitStrikes = oldStore, oldStrikes })
+
+	first := sessionKey{UserId: 536363, ChatId: -100536301}
+	second := sessionKey{UserId: 536363, ChatId: -100536302}
+	var events []*UserJoinEvent
+	for i, key := range []sessionKey{first, second} {
+		gc := DefaultGroupConfig(key.ChatId)
+		gc.ShareVerification = true
+		gc.VerificationTimeoutSeconds += i * 60
+		event, _ := loadOrStartSession(key, "", gc, TriggerJoinRequest)
+		events = append(events, event)
+		t.Cleanup(func() { userStatus.Delete(key) })
+	}
+
+	post := func(r *gin.Engine) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verify", nil))
+		return w.Code
+	}
+	route := func(users, ips *rateLimiter) *gin.Engine {
+		r := gin.New()
+		r.POST("/verify", func(ctx *gin.Context) {
+			ctx.Set("auth", AuthInfo{User: WebInitUser{Id: first.UserId}})
+		}, rateLimitVerify(users, ips), func(ctx *gin.Context) {
+			ctx.Status(http.StatusOK)
+		})
+		return r
+	}
+
+	// 按IP限流不计入用户的限流次数
+	byIP := route(newRateLimiter(0, 0), newRateLimiter(1, 1))
+	post(byIP)
+	if code := post(byIP); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the ip to be limited, got %d", code)
+	}
+	if events[0].State() != userVerifying || events[1].State() != userVerifying {
+		t.Fatal("expected ip limit hits not to fail the sessions")
+	}
+
+	// 按用户限流只判定本次验证所属的会话失败
+	byUser := route(newRateLimiter(1, 1), newRateLimiter(0, 0))
+	post(byUser)
+	post(byUser)
+	if events[0].State() != userVerifyFailed || events[1].State() != userVerifying {
+		t.Fatalf("expected only the earliest session to fail, got %v %v", events[0].State(), events[1].State())
+	}
+}
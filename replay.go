@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/puzpuzpuz/xsync/v4"
+)
+
+const (
+	replayKindInitData  = "init_data"
+	replayKindChallenge = "challenge"
+)
+
+// replayGuard 记录短时间内已经使用过的 token，先查内存，内存中没有时再写入数据库，
+// 这样重启之后在有效期内重放的请求同样会被拒绝。只保存 token 的哈希。
+type replayGuard struct {
+	used *xsync.Map[string, time.Time]
+}
+
+var usedTokens = &replayGuard{used: xsync.NewMap[string, time.Time]()}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// use 标记 token 已被使用直到 expiresAt，返回是否为第一次使用
+func (g *replayGuard) use(kind, token string, expiresAt time.Time) bool {
+	hashed := hashToken(token)
+	now := time.Now()
+	g.used.Range(func(k string, exp time.Time) bool {
+		if now.After(exp) {
+			g.used.Delete(k)
+		}
+		return true
+	})
+	fresh := true
+	g.used.Compute(kind+":"+hashed, func(old time.Time, loaded bool) (time.Time, xsync.ComputeOp) {
+		if loaded && now.Before(old) {
+			fresh = false
+			return old, xsync.CancelOp
+		}
+		return expiresAt, xsync.UpdateOp
+	})
+	if !fresh || persistentStore == nil {
+		return fresh
+	}
+	fresh, err := persistentStore.MarkTokenUsed(kind, hashed, expiresAt)
+	if err != nil {
+		// 数据库不可用时只依赖内存中的记录
+		log.Printf("记录已使用的token失败: %v", err)
+		return true
+	}
+	return fresh
+}
+
+// release 撤销 use 留下的记录，用于 token 还没有得到确定的结果时，让用户可以重新提交
+func (g *replayGuard) release(kind, token string) {
+	hashed := hashToken(token)
+	g.used.Delete(kind + ":" + hashed)
+	if persistentStore == nil {
+		return
+	}
+	if err := persistentStore.UnmarkTokenUsed(kind, hashed); err != nil {
+		log.Printf("撤销已使用的token失败: %v", err)
+	}
+}
+
+// initDataSettledKey 由 verifyChallenge 在提交得到确定的结果（通过或最终失败）时设置
+const initDataSettledKey = "init_data_settled"
+
+// settleInitData 表示这次提交已经有了确定的结果，之后不能再用同一份 initData 提交
+func settleInitData(ctx *gin.Context) {
+	ctx.Set(initDataSettledKey, true)
+}
+
+// rejectReplayedInitData 要求每份 initData 只能用于一次有结果的提交，需要放在 verifyHeader 之后。
+// 处理期间先标记为已使用以拒绝并发的重放，之后没有得到确定结果的提交（验证接口出错、内置验证码还有机会等）
+// 会撤销标记，让页面可以用同一份 initData 重试。
+// 记录保留到 initData 本身过期为止，之后的重放会因为 auth_date 过期而被 verifyHeader 拒绝。
+func rejectReplayedInitData(ctx *gin.Context) {
+	if cfg.Testing {
+		ctx.Next()
+		return
+	}
+	auth := ctx.MustGet("auth").(AuthInfo)
+	if !usedTokens.use(replayKindInitData, auth.replayKey(), auth.AuthDate.Add(cfg.InitDataMaxAge)) {
+		log.Printf("[rejectReplayedInitData] 用户 %d 重复提交了同一份 initData", auth.User.Id)
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.page_replayed"))
+		return
+	}
+	ctx.Next()
+	if !ctx.GetBool(initDataSettledKey) {
+		usedTokens.release(replayKindInitData, auth.replayKey())
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v4"
+)
+
+func TestReplayGuard(t *testing.T) {
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	guard := &replayGuard{used: xsync.NewMap[string, time.Time]()}
+	expires := time.Now().Add(time.Minute)
+	if !guard.use(replayKindInitData, "hash-a", expires) {
+		t.Fatal("expected first use to be accepted")
+	}
+	if guard.use(replayKindInitData, "hash-a", expires) {
+		t.Fatal("expected replay to be rejected")
+	}
+	if !guard.use(replayKindChallenge, "hash-a", expires) {
+		t.Fatal("expected tokens of different kinds not to collide")
+	}
+
+	// 重启后内存中的记录丢失，依然可以通过数据库拒绝重放
+	restarted := &replayGuard{used: xsync.NewMap[string, time.Time]()}
+	if restarted.use(replayKindInitData, "hash-a", expires) {
+		t.Fatal("expected replay after restart to be rejected")
+	}
+
+	if !guard.use(replayKindInitData, "hash-b", time.Now().Add(-time.Second)) {
+		t.Fatal("expected first use to be accepted")
+	}
+	if !restarted.use(replayKindInitData, "hash-b", expires) {
+		t.Fatal("expected expired token record to be ignored")
+	}
+
+	// 撤销之后内存和数据库中的记录都不再拒绝该 token
+	guard.release(replayKindChallenge, "hash-a")
+	if !guard.use(replayKindChallenge, "hash-a", expires) {
+		t.Fatal("expected released token to be accepted again")
+	}
+	guard.release(replayKindChallenge, "hash-a")
+	if !restarted.use(replayKindChallenge, "hash-a", expires) {
+		t.Fatal("expected released token to be removed from the store")
+	}
+}
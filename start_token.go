@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// startToken 放在 startapp 链接中，页面打开后作为 initData 的 start_param 传回，
+// 用于确定本次验证对应的用户与群组。内容为群组id、用户id、过期时间与截断的 HMAC，
+// 使用 base64url 编码，满足 start_param 只允许字母、数字、下划线与减号的要求。
+const (
+	startTokenPayloadSize = 24
+	startTokenMacSize     = 16
+)
+
+var (
+	errStartTokenInvalid = errors.New("invalid start token")
+	errStartTokenExpired = errors.New("start token expired")
+)
+
+var startTokenKey = sync.OnceValue(func() []byte {
+	mac := hmac.New(sha256.New, []byte("StartParam"))
+	mac.Write([]byte(cfg.BotToken))
+	return mac.Sum(nil)
+})
+
+func startTokenMac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, startTokenKey())
+	mac.Write(payload)
+	return mac.Sum(nil)[:startTokenMacSize]
+}
+
+// newStartToken 生成只能用于该用户在该群组的验证会话的 token，expiresAt 一般为会话的截止时间
+func newStartToken(key sessionKey, expiresAt time.Time) string {
+	buf := make([]byte, startTokenPayloadSize, startTokenPayloadSize+startTokenMacSize)
+	binary.BigEndian.PutUint64(buf[0:], uint64(key.ChatId))
+	binary.BigEndian.PutUint64(buf[8:], uint64(key.UserId))
+	binary.BigEndian.PutUint64(buf[16:], uint64(expiresAt.Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(buf, startTokenMac(buf)...))
+}
+
+// parseStartToken 校验 token 并返回其对应的会话
+func parseStartToken(token string, now time.Time) (sessionKey, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) != startTokenPayloadSize+startTokenMacSize {
+		return sessionKey{}, errStartTokenInvalid
+	}
+	payload := buf[:startTokenPayloadSize]
+	if !hmac.Equal(buf[startTokenPayloadSize:], startTokenMac(payload)) {
+		return sessionKey{}, errStartTokenInvalid
+	}
+	key := sessionKey{
+		ChatId: int64(binary.BigEndian.Uint64(payload[0:])),
+		UserId: int64(binary.BigEndian.Uint64(payload[8:])),
+	}
+	if expiresAt := time.Unix(int64(binary.BigEndian.Uint64(payload[16:])), 0); now.After(expiresAt) {
+		return key, fmt.Errorf("%w at %s", errStartTokenExpired, expiresAt.Format(time.DateTime))
+	}
+	return key, nil
+}
+
+// verificationLink 返回打开验证页面的链接，页面可以据此只处理该用户在该群组的验证
+func verificationLink(botUsername string, key sessionKey, expiresAt time.Time) string {
+	return fmt.Sprintf("https://t.me/%s?startapp=%s", botUsername, newStartToken(key, expiresAt))
+}
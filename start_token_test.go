@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStartToken(t *testing.T) {
+	key := sessionKey{UserId: 279058397, ChatId: -1001234567890}
+	now := time.Now()
+	token := newStartToken(key, now.Add(time.Minute))
+	// start_param 最长512个字符，只允许字母、数字、下划线与减号
+	if !regexp.MustCompile(`^[A-Za-z0-9_-]{1,512}$`).MatchString(token) {
+		t.Fatalf("token %q is not a valid start_param", token)
+	}
+	parsed, err := parseStartToken(token, now)
+	if err != nil || parsed != key {
+		t.Fatalf("expected %+v, got %+v (err=%v)", key, parsed, err)
+	}
+
+	if _, err := parseStartToken(token, now.Add(2*time.Minute)); !errors.Is(err, errStartTokenExpired) {
+		t.Fatalf("expected expired error, got %v", err)
+	}
+	other := newStartToken(sessionKey{UserId: 1, ChatId: key.ChatId}, now.Add(time.Minute))
+	// 24字节的内容正好编码为32个字符，用另一个 token 的内容配上原来的 MAC
+	tampered := other[:32] + token[32:]
+	for _, bad := range []string{"", "not a token", token[:len(token)-1], tampered} {
+		if _, err := parseStartToken(bad, now); !errors.Is(err, errStartTokenInvalid) {
+			t.Fatalf("expected invalid error for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestPendingSessionsWithStartToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldStore := persistentStore
+	persistentStore = newTestStore(t)
+	t.Cleanup(func() { persistentStore = oldStore })
+
+	first := sessionKey{UserId: 646464, ChatId: -100646401}
+	second := sessionKey{UserId: 646464, ChatId: -100646402}
+	for _, key := range []sessionKey{first, second} {
+		cfg := DefaultGroupConfig(key.ChatId)
+		cfg.ShareVerification = true
+		event := &UserJoinEvent{}
+		event.Init(key, "start_token_test", cfg, TriggerJoinRequest)
+		userStatus.Store(key, event)
+		t.Cleanup(func() { userStatus.Delete(key) })
+	}
+
+	var resolved []*UserJoinEvent
+	request := func(userId int64, startParam string) int {
+		r := gin.New()
+		r.GET("/", func(ctx *gin.Context) {
+			ctx.Set("auth", AuthInfo{User: WebInitUser{Id: userId}, StartParam: startParam})
+			resolved, _ = pendingSessions(ctx)
+		})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	if code := request(first.UserId, ""); code != http.StatusOK || len(resolved) != 2 {
+		t.Fatalf("expected both shared sessions without start_param, got %d %d", code, len(resolved))
+	}
+	if code := request(first.UserId, newStartToken(second, time.Now().Add(time.Minute))); code != http.StatusOK ||
+		len(resolved) != 1 || resolved[0].ChatId != second.ChatId {
+		t.Fatalf("expected only the session of the token, got %d %+v", code, resolved)
+	}
+	if code := request(1, newStartToken(first, time.Now().Add(time.Minute))); code != http.StatusForbidden {
+		t.Fatalf("expected token of another user to be rejected, got %d", code)
+	}
+	if code := request(first.UserId, newStartToken(first, time.Now().Add(-time.Minute))); code != http.StatusUnauthorized {
+		t.Fatalf("expected expired token to be rejected, got %d", code)
+	}
+	if code := request(first.UserId, "garbage"); code != http.StatusUnauthorized {
+		t.Fatalf("expected invalid token to be rejected, got %d", code)
+	}
+	if code := request(first.UserId, newStartToken(sessionKey{UserId: first.UserId, ChatId: -1}, time.Now().Add(time.Minute))); code != http.StatusNotFound {
+		t.Fatalf("expected missing session to return 404, got %d", code)
+	}
+}
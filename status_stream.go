@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	outcomeApproved = "approved"
+	outcomeDeclined = "declined"
+	outcomeError    = "error"
+
+	// 最终结果保留一段时间，用户在结果产生后才打开页面也能看到
+	statusRetention     = 10 * time.Minute
+	statusStreamTimeout = 5 * time.Minute
+)
+
+// SessionStatus 是推送给验证页面的会话状态，Outcome 为空表示还没有执行同意或拒绝
+type SessionStatus struct {
+	ChatID  int64              `json:"chat_id"`
+	State   VerificationStatus `json:"state"`
+	Outcome string             `json:"outcome,omitempty"`
+	Error   string             `json:"error,omitempty"`
+	updated time.Time
+}
+
+// statusSub 是一个推送连接，只接收 chats 中群组的状态
+type statusSub struct {
+	ch    chan SessionStatus
+	chats []int64
+}
+
+// passRecord 为用户最近一次通过验证时作用到的群组
+type passRecord struct {
+	chats []int64
+	at    time.Time
+}
+
+// statusHub 保存每个会话最近的状态，并推送给订阅了该用户的连接
+type statusHub struct {
+	mu     sync.Mutex
+	latest map[sessionKey]SessionStatus
+	passes map[int64]passRecord
+	subs   map[int64]map[*statusSub]struct{}
+	closed bool
+}
+
+var sessionStatuses = newStatusHub()
+
+func newStatusHub() *statusHub {
+	return &statusHub{
+		latest: make(map[sessionKey]SessionStatus),
+		passes: make(map[int64]passRecord),
+		subs:   make(map[int64]map[*statusSub]struct{}),
+	}
+}
+
+func (h *statusHub) publish(key sessionKey, update func(s *SessionStatus)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for k, s := range h.latest {
+		if now.Sub(s.updated) > statusRetention {
+			delete(h.latest, k)
+		}
+	}
+	s := h.latest[key]
+	s.ChatID = key.ChatId
+	update(&s)
+	s.updated = now
+	h.latest[key] = s
+	for sub := range h.subs[key.UserId] {
+		if !slices.Contains(sub.chats, key.ChatId) {
+			continue
+		}
+		select {
+		case sub.ch <- s:
+		default:
+			// 连接处理不过来时丢弃，页面总会收到之后的状态
+		}
+	}
+}
+
+// recordPass 记录用户这次通过验证作用到的群组，之后打开的推送连接只展示这些群组
+func (h *statusHub) recordPass(userId int64, chats []int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.passes[userId] = passRecord{chats: chats, at: time.Now()}
+}
+
+// lastPass 返回用户最近一次通过验证作用到的群组，超过保留时间的记录视为不存在
+func (h *statusHub) lastPass(userId int64) []int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, p := range h.passes {
+		if time.Since(p.at) > statusRetention {
+			delete(h.passes, id)
+		}
+	}
+	return h.passes[userId].chats
+}
+
+// subscribe 返回用户在 chats 中各个会话当前的状态，以及之后状态变化的通知，使用完毕后需要调用 cancel
+func (h *statusHub) subscribe(userId int64, chats []int64) (snapshot []SessionStatus, updates <-chan SessionStatus, cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, s := range h.latest {
+		if key.UserId == userId && slices.Contains(chats, key.ChatId) {
+			snapshot = append(snapshot, s)
+		}
+	}
+	sub := &statusSub{ch: make(chan SessionStatus, 16), chats: chats}
+	if h.closed {
+		close(sub.ch)
+		return snapshot, sub.ch, func() {}
+	}
+	if h.subs[userId] == nil {
+		h.subs[userId] = make(map[*statusSub]struct{})
+	}
+	h.subs[userId][sub] = struct{}{}
+	return snapshot, sub.ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[userId][sub]; !ok {
+			return
+		}
+		delete(h.subs[userId], sub)
+		if len(h.subs[userId]) == 0 {
+			delete(h.subs, userId)
+		}
+		close(sub.ch)
+	}
+}
+
+// closeAll 在关闭 HTTP 服务时结束所有推送连接，避免长连接拖住关闭流程
+func (h *statusHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for userId, subs := range h.subs {
+		for sub := range subs {
+			close(sub.ch)
+		}
+		delete(h.subs, userId)
+	}
+}
+
+func publishSessionState(key sessionKey, state UserJoinState) {
+	sessionStatuses.publish(key, func(s *SessionStatus) {
+		s.State = statusOf(state)
+		if state == userVerifying {
+			s.Outcome, s.Error = "", ""
+		}
+	})
+}
+
+// publishSessionOutcome 记录同意或拒绝操作的结果，err 不为空时结果为 error
+func publishSessionOutcome(key sessionKey, outcome string, err error) {
+	sessionStatuses.publish(key, func(s *SessionStatus) {
+		s.Outcome, s.Error = outcome, ""
+		if err != nil {
+			s.Outcome, s.Error = outcomeError, err.Error()
+		}
+	})
+}
+
+// statusChats 返回推送连接需要展示的群组：带 token 打开时只有 token 对应的群组，
+// 否则为用户最近一次通过验证作用到的群组，与 verifyChallenge 处理的会话一致
+func statusChats(ctx *gin.Context) ([]int64, bool) {
+	auth := ctx.MustGet("auth").(AuthInfo)
+	if auth.StartParam == "" {
+		return sessionStatuses.lastPass(auth.User.Id), true
+	}
+	key, err := parseStartToken(auth.StartParam, time.Now())
+	switch {
+	case errors.Is(err, errStartTokenExpired):
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.link_expired"))
+		return nil, false
+	case err != nil:
+		log.Printf("[statusStream] 用户 %d 的 start_param 无效: %v", auth.User.Id, err)
+		ctx.AbortWithStatusJSON(401, hErrT(ctx, "api.link_invalid"))
+		return nil, false
+	case key.UserId != auth.User.Id:
+		ctx.AbortWithStatusJSON(403, hErrT(ctx, "api.link_not_yours"))
+		return nil, false
+	}
+	return []int64{key.ChatId}, true
+}
+
+// statusStream 以 Server-Sent Events 推送本次验证涉及的各个会话的状态，所有会话都有最终结果后结束
+func statusStream(ctx *gin.Context) {
+	auth := ctx.MustGet("auth").(AuthInfo)
+	chats, ok := statusChats(ctx)
+	if !ok {
+		return
+	}
+	snapshot, updates, cancel := sessionStatuses.subscribe(auth.User.Id, chats)
+	defer cancel()
+	if len(snapshot) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, hErrT(ctx, "api.no_join_request"))
+		return
+	}
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+
+	unfinished := make(map[int64]bool)
+	send := func(s SessionStatus) {
+		unfinished[s.ChatID] = s.Outcome == ""
+		ctx.SSEvent("session", s)
+		ctx.Writer.Flush()
+	}
+	for _, s := range snapshot {
+		send(s)
+	}
+	timeout := time.NewTimer(statusStreamTimeout)
+	defer timeout.Stop()
+	for {
+		finished := true
+		for _, v := range unfinished {
+			finished = finished && !v
+		}
+		if finished {
+			ctx.SSEvent("done", "")
+			ctx.Writer.Flush()
+			return
+		}
+		select {
+		case s, ok := <-updates:
+			if !ok {
+				return
+			}
+			send(s)
+		case <-timeout.C:
+			return
+		case <-ctx.Request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStatusHub(t *testing.T) {
+	hub := newStatusHub()
+	key := sessionKey{UserId: 1, ChatId: 10}
+	hub.publish(key, func(s *SessionStatus) { s.State = StatusVerifying })
+
+	snapshot, updates, cancel := hub.subscribe(1, []int64{10})
+	defer cancel()
+	if len(snapshot) != 1 || snapshot[0].State != StatusVerifying {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+	if other, _, cancelOther := hub.subscribe(2, []int64{10}); len(other) != 0 {
+		t.Fatalf("expected snapshot to be scoped to user, got %+v", other)
+	} else {
+		cancelOther()
+	}
+	if other, _, cancelOther := hub.subscribe(1, []int64{11}); len(other) != 0 {
+		t.Fatalf("expected snapshot to be scoped to chats, got %+v", other)
+	} else {
+		cancelOther()
+	}
+
+	hub.publish(key, func(s *SessionStatus) { s.State = StatusSuccess })
+	hub.publish(key, func(s *SessionStatus) { s.Outcome = outcomeApproved })
+	if s := <-updates; s.State != StatusSuccess || s.Outcome != "" {
+		t.Fatalf("unexpected update: %+v", s)
+	}
+	if s := <-updates; s.Outcome != outcomeApproved || s.ChatID != 10 {
+		t.Fatalf("unexpected update: %+v", s)
+	}
+
+	hub.closeAll()
+	if _, ok := <-updates; ok {
+		t.Fatal("expected updates to be closed on shutdown")
+	}
+	cancel()
+}
+
+func TestStatusStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := sessionStatuses
+	sessionStatuses = newStatusHub()
+	t.Cleanup(func() { sessionStatuses = old })
+
+	r := gin.New()
+	r.GET("/status", func(ctx *gin.Context) {
+		ctx.Set("auth", AuthInfo{User: WebInitUser{Id: 7}})
+	}, statusStream)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without sessions, got %d", w.Code)
+	}
+
+	key := sessionKey{UserId: 7, ChatId: 70}
+	sessionStatuses.recordPass(key.UserId, []int64{key.ChatId})
+	publishSessionState(key, userVerifying)
+	// 不属于这次验证的群组不会出现在推送中
+	publishSessionState(sessionKey{UserId: 7, ChatId: 71}, userVerifying)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	// 收到快照说明连接已经订阅，之后发布的状态一定会推送过来
+	reader := bufio.NewReader(resp.Body)
+	var received strings.Builder
+	for !strings.Contains(received.String(), `"state":"verifying"`) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before the snapshot: %v\n%s", err, received.String())
+		}
+		received.WriteString(line)
+	}
+	publishSessionState(key, userVerifySucceed)
+	publishSessionOutcome(key, outcomeApproved, errors.New("CHAT_ADMIN_REQUIRED"))
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := received.String() + string(rest)
+	for _, want := range []string{`"state":"verifying"`, `"state":"success"`, `"outcome":"error","error":"CHAT_ADMIN_REQUIRED"`, "event:done"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected stream to contain %s, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `"chat_id":71`) {
+		t.Fatalf("expected stream to be scoped to the passed chats, got:\n%s", body)
+	}
+}
+
+func TestStatusChats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := sessionStatuses
+	sessionStatuses = newStatusHub()
+	t.Cleanup(func() { sessionStatuses = old })
+
+	key := sessionKey{UserId: 8, ChatId: 80}
+	sessionStatuses.recordPass(key.UserId, []int64{80, 81})
+	chatsFor := func(startParam string) ([]int64, int) {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/status", nil)
+		ctx.Set("auth", AuthInfo{User: WebInitUser{Id: key.UserId}, StartParam: startParam})
+		chats, _ := statusChats(ctx)
+		return chats, ctx.Writer.Status()
+	}
+	if chats, _ := chatsFor(""); len(chats) != 2 {
+		t.Fatalf("expected the chats of the last pass, got %v", chats)
+	}
+	// 带 token 时只展示 token 对应的群组
+	if chats, _ := chatsFor(newStartToken(sessionKey{UserId: 8, ChatId: 81}, time.Now().Add(time.Minute))); len(chats) != 1 || chats[0] != 81 {
+		t.Fatalf("expected only the chat of the token, got %v", chats)
+	}
+	if _, code := chatsFor(newStartToken(sessionKey{UserId: 9, ChatId: 81}, time.Now().Add(time.Minute))); code != http.StatusForbidden {
+		t.Fatalf("expected a token of another user to be rejected, got %d", code)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -16,17 +18,88 @@ const (
 	StatusFailed    VerificationStatus = "failed"
 )
 
+type PendingSource string
+
+const (
+	PendingSourceJoinRequest PendingSource = "join_request"
+	PendingSourceInviteLink  PendingSource = "invite_link"
+)
+
+// VerificationTrigger 表示验证状态变化的来源，验证服务通过时使用验证服务的名字
+type VerificationTrigger string
+
+const (
+	TriggerJoinRequest VerificationTrigger = "join_request"
+	TriggerInviteLink  VerificationTrigger = "invite_link"
+	TriggerRestore     VerificationTrigger = "restore"
+	TriggerTimeout     VerificationTrigger = "timeout"
+	TriggerCooldown    VerificationTrigger = "cooldown"
+	TriggerInline      VerificationTrigger = "inline"
+	TriggerAdmin       VerificationTrigger = "admin"
+	TriggerRateLimit   VerificationTrigger = "rate_limit"
+	TriggerTesting     VerificationTrigger = "testing"
+)
+
 type PersistentStore struct {
 	db *sql.DB
 }
 
 type GroupConfig struct {
-	ChatID                     int64
-	RequireFollowupMessage     bool
-	VerificationTimeoutSeconds int
-	FailureBanCooldownSeconds  int
-	KickGracePeriodSeconds     int
-	UpdatedAt                  time.Time
+	ChatID                     int64 `json:"chat_id"`
+	RequireFollowupMessage     bool  `json:"require_followup_message"`
+	VerificationTimeoutSeconds int   `json:"verification_timeout_seconds"`
+	FailureBanCooldownSeconds  int   `json:"failure_ban_cooldown_seconds"`
+	KickGracePeriodSeconds     int   `json:"kick_grace_period_seconds"`
+	// ShareVerification 为真时，用户为其他群组完成的人类验证也可以用于本群
+	ShareVerification bool `json:"share_verification"`
+	// ChallengeProvider 为空时使用全局配置的人机验证服务
+	ChallengeProvider string `json:"challenge_provider"`
+	// VerifyMode 为 webapp、inline 或 both，决定发送小程序链接还是按钮验证
+	VerifyMode string `json:"verify_mode"`
+	// Language 为群组消息使用的语言，为空时使用默认语言
+	Language  string    `json:"language"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UserVerification 是 user_verifications 中用户在一个群组最近一次的验证状态
+type UserVerification struct {
+	UserID    int64              `json:"user_id"`
+	ChatID    int64              `json:"chat_id"`
+	Username  string             `json:"username"`
+	Status    VerificationStatus `json:"status"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+type PendingGroup struct {
+	UserID      int64
+	ChatID      int64
+	Username    string
+	Source      PendingSource
+	RequestedAt time.Time
+	// Deadline 为零值表示该记录来自没有截止时间字段的旧版本数据库
+	Deadline time.Time
+}
+
+// VerificationEvent 是 verification_events 中的一条状态变化记录，OldStatus 为空表示会话刚开始
+type VerificationEvent struct {
+	ID         int64               `json:"id"`
+	UserID     int64               `json:"user_id"`
+	ChatID     int64               `json:"chat_id"`
+	OldStatus  VerificationStatus  `json:"old_status"`
+	NewStatus  VerificationStatus  `json:"new_status"`
+	Trigger    VerificationTrigger `json:"trigger"`
+	ErrorCodes []string            `json:"error_codes,omitempty"`
+	ClientIP   string              `json:"client_ip,omitempty"`
+	CreatedAt  time.Time           `json:"created_at"`
+}
+
+// VerificationEventFilter 的零值字段表示不按该条件过滤，Limit 为0时最多返回100条
+type VerificationEventFilter struct {
+	UserID int64
+	ChatID int64
+	Since  time.Time
+	Until  time.Time
+	Limit  int
 }
 
 func NewPersistentStore(path string) (*PersistentStore, error) {
@@ -47,13 +120,30 @@ func NewPersistentStore(path string) (*PersistentStore, error) {
 	return store, nil
 }
 
+// Close 关闭数据库连接，WAL 中的内容会在关闭时写回数据库文件
+func (p *PersistentStore) Close() error {
+	if p == nil {
+		return errors.New("nil persistent store")
+	}
+	return p.db.Close()
+}
+
+func (p *PersistentStore) Ping(ctx context.Context) error {
+	if p == nil {
+		return errors.New("nil persistent store")
+	}
+	return p.db.PingContext(ctx)
+}
+
 func (p *PersistentStore) initTables() error {
 	schema := []string{
 		`CREATE TABLE IF NOT EXISTS user_verifications (
-                        user_id INTEGER PRIMARY KEY,
+                        user_id INTEGER NOT NULL,
+                        chat_id INTEGER NOT NULL,
                         username TEXT,
                         status TEXT NOT NULL,
-                        updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+                        updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                        PRIMARY KEY (user_id, chat_id)
                 );`,
 		`CREATE TABLE IF NOT EXISTS group_configs (
                         chat_id INTEGER PRIMARY KEY,
@@ -61,46 +151,207 @@ func (p *PersistentStore) initTables() error {
                         verification_timeout_seconds INTEGER NOT NULL DEFAULT 360,
                         failure_ban_cooldown_seconds INTEGER NOT NULL DEFAULT 600,
                         kick_grace_period_seconds INTEGER NOT NULL DEFAULT 600,
+                        share_verification INTEGER NOT NULL DEFAULT 1,
+                        challenge_provider TEXT NOT NULL DEFAULT '',
+                        verify_mode TEXT NOT NULL DEFAULT 'webapp',
+                        language TEXT NOT NULL DEFAULT '',
                         updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
                 );`,
 		`CREATE TABLE IF NOT EXISTS pending_groups (
                         user_id INTEGER NOT NULL,
                         chat_id INTEGER NOT NULL,
                         requested_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                        source TEXT NOT NULL DEFAULT 'join_request',
+                        deadline TIMESTAMP,
                         PRIMARY KEY (user_id, chat_id)
                 );`,
+		`CREATE TABLE IF NOT EXISTS join_cooldowns (
+                        user_id INTEGER NOT NULL,
+                        chat_id INTEGER NOT NULL,
+                        until TIMESTAMP NOT NULL,
+                        PRIMARY KEY (user_id, chat_id)
+                );`,
+		`CREATE TABLE IF NOT EXISTS verification_events (
+                        id INTEGER PRIMARY KEY AUTOINCREMENT,
+                        user_id INTEGER NOT NULL,
+                        chat_id INTEGER NOT NULL,
+                        old_status TEXT NOT NULL,
+                        new_status TEXT NOT NULL,
+                        triggered_by TEXT NOT NULL,
+                        error_codes TEXT NOT NULL DEFAULT '',
+                        client_ip TEXT NOT NULL DEFAULT '',
+                        created_at TIMESTAMP NOT NULL
+                );`,
+		`CREATE INDEX IF NOT EXISTS idx_verification_events_user ON verification_events (user_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_verification_events_chat ON verification_events (chat_id, created_at);`,
+		`CREATE TABLE IF NOT EXISTS used_tokens (
+                        kind TEXT NOT NULL,
+                        token TEXT NOT NULL,
+                        expires_at TIMESTAMP NOT NULL,
+                        PRIMARY KEY (kind, token)
+                );`,
+		`CREATE TABLE IF NOT EXISTS group_templates (
+                        chat_id INTEGER NOT NULL,
+                        name TEXT NOT NULL,
+                        template TEXT NOT NULL,
+                        updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                        PRIMARY KEY (chat_id, name)
+                );`,
 	}
 	for _, stmt := range schema {
 		if _, err := p.db.Exec(stmt); err != nil {
 			return err
 		}
 	}
-	return nil
+	// 旧版本创建的表不会因为 CREATE TABLE IF NOT EXISTS 获得新列，需要单独补上
+	columns := []struct{ table, column, decl string }{
+		{"pending_groups", "source", "TEXT NOT NULL DEFAULT 'join_request'"},
+		{"pending_groups", "deadline", "TIMESTAMP"},
+		{"group_configs", "share_verification", "INTEGER NOT NULL DEFAULT 1"},
+		{"group_configs", "challenge_provider", "TEXT NOT NULL DEFAULT ''"},
+		{"group_configs", "verify_mode", "TEXT NOT NULL DEFAULT 'webapp'"},
+		{"group_configs", "language", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range columns {
+		if err := p.addColumnIfMissing(c.table, c.column, c.decl); err != nil {
+			return err
+		}
+	}
+	return p.migrateUserVerifications()
+}
+
+func (p *PersistentStore) hasColumn(table, column string) (bool, error) {
+	rows, err := p.db.Query(`SELECT name FROM pragma_table_info(?);`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
 }
 
-func (p *PersistentStore) UpsertUserVerification(userID int64, username string, status VerificationStatus) error {
+func (p *PersistentStore) addColumnIfMissing(table, column, decl string) error {
+	// hasColumn 返回时已经关闭了查询，否则唯一的连接会被占用，ALTER 无法执行
+	ok, err := p.hasColumn(table, column)
+	if err != nil || ok {
+		return err
+	}
+	_, err = p.db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl + `;`)
+	return err
+}
+
+// migrateUserVerifications 将旧版本以 user_id 为主键的 user_verifications 重建为按用户与群组保存。
+// SQLite 不能修改主键，只能建新表复制数据：旧的状态复制到该用户每个待验证的群组，没有待验证群组的记为群组0。
+func (p *PersistentStore) migrateUserVerifications() error {
+	ok, err := p.hasColumn("user_verifications", "chat_id")
+	if err != nil || ok {
+		return err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmts := []string{
+		`CREATE TABLE user_verifications_new (
+                        user_id INTEGER NOT NULL,
+                        chat_id INTEGER NOT NULL,
+                        username TEXT,
+                        status TEXT NOT NULL,
+                        updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                        PRIMARY KEY (user_id, chat_id)
+                );`,
+		`INSERT INTO user_verifications_new (user_id, chat_id, username, status, updated_at)
+SELECT uv.user_id, COALESCE(pg.chat_id, 0), uv.username, uv.status, uv.updated_at
+FROM user_verifications uv
+LEFT JOIN pending_groups pg ON pg.user_id = uv.user_id;`,
+		`DROP TABLE user_verifications;`,
+		`ALTER TABLE user_verifications_new RENAME TO user_verifications;`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PersistentStore) UpsertUserVerification(userID, chatID int64, username string, status VerificationStatus) error {
 	if p == nil {
 		return errors.New("nil persistent store")
 	}
-	_, err := p.db.Exec(`INSERT INTO user_verifications (user_id, username, status, updated_at)
-VALUES (?, ?, ?, CURRENT_TIMESTAMP)
-ON CONFLICT(user_id) DO UPDATE SET username=excluded.username, status=excluded.status, updated_at=excluded.updated_at;
-`, userID, username, status)
+	_, err := p.db.Exec(`INSERT INTO user_verifications (user_id, chat_id, username, status, updated_at)
+VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+ON CONFLICT(user_id, chat_id) DO UPDATE SET username=excluded.username, status=excluded.status, updated_at=excluded.updated_at;
+`, userID, chatID, username, status)
 	return err
 }
 
+// ListUserVerifications 返回用户在各个群组最近一次的验证状态，按群组id排序
+func (p *PersistentStore) ListUserVerifications(userID int64) ([]UserVerification, error) {
+	if p == nil {
+		return nil, errors.New("nil persistent store")
+	}
+	rows, err := p.db.Query(`SELECT user_id, chat_id, COALESCE(username, ''), status, updated_at FROM user_verifications
+WHERE user_id = ? ORDER BY chat_id;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []UserVerification
+	for rows.Next() {
+		var uv UserVerification
+		if err := rows.Scan(&uv.UserID, &uv.ChatID, &uv.Username, &uv.Status, &uv.UpdatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, uv)
+	}
+	return result, rows.Err()
+}
+
+// ResetUserVerification 删除用户保存的验证状态以及所有群组的入群冷却，验证记录会保留
+func (p *PersistentStore) ResetUserVerification(userID int64) error {
+	if p == nil {
+		return errors.New("nil persistent store")
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM user_verifications WHERE user_id = ?;`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM join_cooldowns WHERE user_id = ?;`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (p *PersistentStore) UpsertGroupConfig(cfg GroupConfig) error {
 	if p == nil {
 		return errors.New("nil persistent store")
 	}
-	_, err := p.db.Exec(`INSERT INTO group_configs (chat_id, require_followup_message, verification_timeout_seconds, failure_ban_cooldown_seconds, kick_grace_period_seconds, updated_at)
-VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	_, err := p.db.Exec(`INSERT INTO group_configs (chat_id, require_followup_message, verification_timeout_seconds, failure_ban_cooldown_seconds, kick_grace_period_seconds, share_verification, challenge_provider, verify_mode, language, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
 ON CONFLICT(chat_id) DO UPDATE SET require_followup_message=excluded.require_followup_message,
         verification_timeout_seconds=excluded.verification_timeout_seconds,
         failure_ban_cooldown_seconds=excluded.failure_ban_cooldown_seconds,
         kick_grace_period_seconds=excluded.kick_grace_period_seconds,
+        share_verification=excluded.share_verification,
+        challenge_provider=excluded.challenge_provider,
+        verify_mode=excluded.verify_mode,
+        language=excluded.language,
         updated_at=excluded.updated_at;
-`, cfg.ChatID, cfg.RequireFollowupMessage, cfg.VerificationTimeoutSeconds, cfg.FailureBanCooldownSeconds, cfg.KickGracePeriodSeconds)
+`, cfg.ChatID, cfg.RequireFollowupMessage, cfg.VerificationTimeoutSeconds, cfg.FailureBanCooldownSeconds, cfg.KickGracePeriodSeconds, cfg.ShareVerification, cfg.ChallengeProvider, cfg.VerifyMode, cfg.Language)
 	return err
 }
 
@@ -108,45 +359,339 @@ func (p *PersistentStore) GetOrCreateGroupConfig(chatID int64) (GroupConfig, err
 	if p == nil {
 		return GroupConfig{}, errors.New("nil persistent store")
 	}
-	defaultCfg := GroupConfig{
+	defaultCfg := DefaultGroupConfig(chatID)
+	if _, err := p.db.Exec(`INSERT INTO group_configs (chat_id) VALUES (?) ON CONFLICT(chat_id) DO NOTHING;`, chatID); err != nil {
+		return GroupConfig{}, err
+	}
+	row := p.db.QueryRow(`SELECT `+groupConfigColumns+` FROM group_configs WHERE chat_id = ?;`, chatID)
+	cfg, err := scanGroupConfig(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaultCfg, nil
+	}
+	return cfg, err
+}
+
+const groupConfigColumns = `chat_id, require_followup_message, verification_timeout_seconds, failure_ban_cooldown_seconds, kick_grace_period_seconds, share_verification, challenge_provider, verify_mode, language, updated_at`
+
+func scanGroupConfig(row interface{ Scan(dest ...any) error }) (GroupConfig, error) {
+	cfg := GroupConfig{}
+	var requireFollowup, shareVerification int
+	if err := row.Scan(&cfg.ChatID, &requireFollowup, &cfg.VerificationTimeoutSeconds, &cfg.FailureBanCooldownSeconds, &cfg.KickGracePeriodSeconds, &shareVerification, &cfg.ChallengeProvider, &cfg.VerifyMode, &cfg.Language, &cfg.UpdatedAt); err != nil {
+		return GroupConfig{}, err
+	}
+	cfg.RequireFollowupMessage = requireFollowup != 0
+	cfg.ShareVerification = shareVerification != 0
+	return cfg, nil
+}
+
+// ListGroupConfigs 返回所有已保存的群组配置，群组第一次使用时会自动保存默认配置
+func (p *PersistentStore) ListGroupConfigs() ([]GroupConfig, error) {
+	if p == nil {
+		return nil, errors.New("nil persistent store")
+	}
+	rows, err := p.db.Query(`SELECT ` + groupConfigColumns + ` FROM group_configs ORDER BY chat_id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []GroupConfig
+	for rows.Next() {
+		cfg, err := scanGroupConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, cfg)
+	}
+	return result, rows.Err()
+}
+
+// DefaultGroupConfig 返回与数据表默认值一致的群组配置
+func DefaultGroupConfig(chatID int64) GroupConfig {
+	return GroupConfig{
 		ChatID:                     chatID,
 		RequireFollowupMessage:     false,
 		VerificationTimeoutSeconds: 360,
 		FailureBanCooldownSeconds:  600,
 		KickGracePeriodSeconds:     600,
+		ShareVerification:          true,
+		VerifyMode:                 "webapp",
 	}
-	if _, err := p.db.Exec(`INSERT INTO group_configs (chat_id) VALUES (?) ON CONFLICT(chat_id) DO NOTHING;`, chatID); err != nil {
-		return GroupConfig{}, err
+}
+
+// SetGroupTemplate 保存群组自定义的消息模板
+func (p *PersistentStore) SetGroupTemplate(chatID int64, name, text string) error {
+	if p == nil {
+		return errors.New("nil persistent store")
 	}
-	row := p.db.QueryRow(`SELECT chat_id, require_followup_message, verification_timeout_seconds, failure_ban_cooldown_seconds, kick_grace_period_seconds, updated_at FROM group_configs WHERE chat_id = ?;`, chatID)
-	cfg := GroupConfig{}
-	var requireFollowup int
-	if err := row.Scan(&cfg.ChatID, &requireFollowup, &cfg.VerificationTimeoutSeconds, &cfg.FailureBanCooldownSeconds, &cfg.KickGracePeriodSeconds, &cfg.UpdatedAt); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return defaultCfg, nil
+	_, err := p.db.Exec(`INSERT INTO group_templates (chat_id, name, template, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+ON CONFLICT(chat_id, name) DO UPDATE SET template=excluded.template, updated_at=CURRENT_TIMESTAMP;
+`, chatID, name, text)
+	return err
+}
+
+// GetGroupTemplate 返回群组自定义的消息模板，没有自定义时返回 false
+func (p *PersistentStore) GetGroupTemplate(chatID int64, name string) (string, bool, error) {
+	if p == nil {
+		return "", false, errors.New("nil persistent store")
+	}
+	var text string
+	err := p.db.QueryRow(`SELECT template FROM group_templates WHERE chat_id = ? AND name = ?;`, chatID, name).Scan(&text)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return text, true, nil
+}
+
+// ListGroupTemplates 返回群组全部自定义的消息模板，key 为模板名
+func (p *PersistentStore) ListGroupTemplates(chatID int64) (map[string]string, error) {
+	if p == nil {
+		return nil, errors.New("nil persistent store")
+	}
+	rows, err := p.db.Query(`SELECT name, template FROM group_templates WHERE chat_id = ?;`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]string)
+	for rows.Next() {
+		var name, text string
+		if err := rows.Scan(&name, &text); err != nil {
+			return nil, err
 		}
-		return GroupConfig{}, err
+		result[name] = text
 	}
-	cfg.RequireFollowupMessage = requireFollowup != 0
-	return cfg, nil
+	return result, rows.Err()
+}
+
+// DeleteGroupTemplate 删除群组自定义的消息模板，恢复为默认文本
+func (p *PersistentStore) DeleteGroupTemplate(chatID int64, name string) error {
+	if p == nil {
+		return errors.New("nil persistent store")
+	}
+	_, err := p.db.Exec(`DELETE FROM group_templates WHERE chat_id = ? AND name = ?;`, chatID, name)
+	return err
+}
+
+func (p *PersistentStore) AddPendingGroup(userID, chatID int64, source PendingSource, deadline time.Time) error {
+	if p == nil {
+		return errors.New("nil persistent store")
+	}
+	_, err := p.db.Exec(`INSERT INTO pending_groups (user_id, chat_id, source, deadline) VALUES (?, ?, ?, ?)
+ON CONFLICT(user_id, chat_id) DO UPDATE SET requested_at=CURRENT_TIMESTAMP, source=excluded.source, deadline=excluded.deadline;
+`, userID, chatID, source, deadline.UTC())
+	return err
+}
+
+// ListPendingVerifications 返回所有仍处于验证中的待加入群组记录，用于重启后恢复状态。
+// 验证会话结束时对应记录会被删除，因此表中剩余的记录都视为验证中。
+func (p *PersistentStore) ListPendingVerifications() ([]PendingGroup, error) {
+	if p == nil {
+		return nil, errors.New("nil persistent store")
+	}
+	rows, err := p.db.Query(`SELECT pg.user_id, pg.chat_id, COALESCE(uv.username, ''), pg.source, pg.requested_at, pg.deadline
+FROM pending_groups pg
+LEFT JOIN user_verifications uv ON uv.user_id = pg.user_id AND uv.chat_id = pg.chat_id
+ORDER BY pg.user_id, pg.chat_id;
+`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []PendingGroup
+	for rows.Next() {
+		var pg PendingGroup
+		var deadline sql.NullTime
+		if err := rows.Scan(&pg.UserID, &pg.ChatID, &pg.Username, &pg.Source, &pg.RequestedAt, &deadline); err != nil {
+			return nil, err
+		}
+		if deadline.Valid {
+			pg.Deadline = deadline.Time
+		}
+		result = append(result, pg)
+	}
+	return result, rows.Err()
+}
+
+// SetPendingDeadline 更新已有待加入群组记录的截止时间，没有记录时不做任何操作
+func (p *PersistentStore) SetPendingDeadline(userID, chatID int64, deadline time.Time) error {
+	if p == nil {
+		return errors.New("nil persistent store")
+	}
+	_, err := p.db.Exec(`UPDATE pending_groups SET deadline = ? WHERE user_id = ? AND chat_id = ?;`, deadline.UTC(), userID, chatID)
+	return err
+}
+
+func (p *PersistentStore) DeletePendingGroup(userID, chatID int64) error {
+	if p == nil {
+		return errors.New("nil persistent store")
+	}
+	_, err := p.db.Exec(`DELETE FROM pending_groups WHERE user_id = ? AND chat_id = ?;`, userID, chatID)
+	return err
+}
+
+// SetJoinCooldown 记录用户在 until 之前不能再次申请加入该群组，同时清理已经过期的记录
+func (p *PersistentStore) SetJoinCooldown(userID, chatID int64, until time.Time) error {
+	if p == nil {
+		return errors.New("nil persistent store")
+	}
+	if _, err := p.db.Exec(`DELETE FROM join_cooldowns WHERE until < ?;`, time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err := p.db.Exec(`INSERT INTO join_cooldowns (user_id, chat_id, until) VALUES (?, ?, ?)
+ON CONFLICT(user_id, chat_id) DO UPDATE SET until=excluded.until;
+`, userID, chatID, until.UTC())
+	return err
+}
+
+// GetJoinCooldown 返回用户在该群组的冷却截止时间，没有冷却或已经过期时返回零值
+func (p *PersistentStore) GetJoinCooldown(userID, chatID int64) (time.Time, error) {
+	if p == nil {
+		return time.Time{}, errors.New("nil persistent store")
+	}
+	var until time.Time
+	err := p.db.QueryRow(`SELECT until FROM join_cooldowns WHERE user_id = ? AND chat_id = ?;`, userID, chatID).Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !until.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// MarkTokenUsed 记录 token 已被使用，返回是否为第一次使用，过期的记录会被清理后视为未使用
+func (p *PersistentStore) MarkTokenUsed(kind, token string, expiresAt time.Time) (bool, error) {
+	if p == nil {
+		return false, errors.New("nil persistent store")
+	}
+	if _, err := p.db.Exec(`DELETE FROM used_tokens WHERE expires_at < ?;`, time.Now().UTC()); err != nil {
+		return false, err
+	}
+	res, err := p.db.Exec(`INSERT INTO used_tokens (kind, token, expires_at) VALUES (?, ?, ?) ON CONFLICT(kind, token) DO NOTHING;`,
+		kind, token, expiresAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
 }
 
-func (p *PersistentStore) AddPendingGroup(userID, chatID int64) error {
+func (p *PersistentStore) UnmarkTokenUsed(kind, token string) error {
 	if p == nil {
 		return errors.New("nil persistent store")
 	}
-	_, err := p.db.Exec(`INSERT INTO pending_groups (user_id, chat_id) VALUES (?, ?) ON CONFLICT(user_id, chat_id) DO UPDATE SET requested_at=CURRENT_TIMESTAMP;`, userID, chatID)
+	_, err := p.db.Exec(`DELETE FROM used_tokens WHERE kind = ? AND token = ?;`, kind, token)
 	return err
 }
 
-func (p *PersistentStore) DeletePendingGroupsByUser(userID int64) error {
+func (p *PersistentStore) AddVerificationEvent(e VerificationEvent) error {
 	if p == nil {
 		return errors.New("nil persistent store")
 	}
-	_, err := p.db.Exec(`DELETE FROM pending_groups WHERE user_id = ?;`, userID)
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	_, err := p.db.Exec(`INSERT INTO verification_events (user_id, chat_id, old_status, new_status, triggered_by, error_codes, client_ip, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+`, e.UserID, e.ChatID, e.OldStatus, e.NewStatus, e.Trigger, strings.Join(e.ErrorCodes, ","), e.ClientIP, e.CreatedAt.UTC())
 	return err
 }
 
+// QueryVerificationEvents 按过滤条件返回状态变化记录，新的记录在前
+func (p *PersistentStore) QueryVerificationEvents(filter VerificationEventFilter) ([]VerificationEvent, error) {
+	if p == nil {
+		return nil, errors.New("nil persistent store")
+	}
+	var conds []string
+	var args []any
+	if filter.UserID != 0 {
+		conds = append(conds, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if filter.ChatID != 0 {
+		conds = append(conds, "chat_id = ?")
+		args = append(args, filter.ChatID)
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, filter.Until.UTC())
+	}
+	query := `SELECT id, user_id, chat_id, old_status, new_status, triggered_by, error_codes, client_ip, created_at FROM verification_events`
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += " ORDER BY id DESC LIMIT ?;"
+	args = append(args, limit)
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []VerificationEvent
+	for rows.Next() {
+		var e VerificationEvent
+		var errorCodes string
+		if err := rows.Scan(&e.ID, &e.UserID, &e.ChatID, &e.OldStatus, &e.NewStatus, &e.Trigger, &errorCodes, &e.ClientIP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if errorCodes != "" {
+			e.ErrorCodes = strings.Split(errorCodes, ",")
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// GroupVerificationStats 是一个群组在统计时间段内结束的验证数量
+type GroupVerificationStats struct {
+	ChatID    int64 `json:"chat_id"`
+	Succeeded int   `json:"succeeded"`
+	Failed    int   `json:"failed"`
+}
+
+// VerificationStats 按群组统计 since 之后验证通过与失败的次数，包括冷却期内被直接拒绝的申请
+func (p *PersistentStore) VerificationStats(since time.Time) ([]GroupVerificationStats, error) {
+	if p == nil {
+		return nil, errors.New("nil persistent store")
+	}
+	rows, err := p.db.Query(`SELECT chat_id,
+        SUM(CASE WHEN new_status = ? THEN 1 ELSE 0 END),
+        SUM(CASE WHEN new_status = ? THEN 1 ELSE 0 END)
+FROM verification_events
+WHERE created_at >= ? AND new_status IN (?, ?)
+GROUP BY chat_id
+ORDER BY chat_id;
+`, StatusSuccess, StatusFailed, since.UTC(), StatusSuccess, StatusFailed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []GroupVerificationStats
+	for rows.Next() {
+		var st GroupVerificationStats
+		if err := rows.Scan(&st.ChatID, &st.Succeeded, &st.Failed); err != nil {
+			return nil, err
+		}
+		result = append(result, st)
+	}
+	return result, rows.Err()
+}
+
 func (g GroupConfig) VerificationTimeout() time.Duration {
 	if g.VerificationTimeoutSeconds <= 0 {
 		return time.Minute * 6
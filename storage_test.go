@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"path/filepath"
 	"testing"
@@ -23,14 +24,18 @@ func newTestStore(t *testing.T) *PersistentStore {
 func TestUpsertUserVerification(t *testing.T) {
 	store := newTestStore(t)
 
-	if err := store.UpsertUserVerification(123, "alice", StatusVerifying); err != nil {
+	if err := store.UpsertUserVerification(123, 10, "alice", StatusVerifying); err != nil {
 		t.Fatalf("insert failed: %v", err)
 	}
-	if err := store.UpsertUserVerification(123, "alice_new", StatusSuccess); err != nil {
+	if err := store.UpsertUserVerification(123, 10, "alice_new", StatusSuccess); err != nil {
 		t.Fatalf("update failed: %v", err)
 	}
+	// 其他群组的会话有独立的状态，不会覆盖本群的
+	if err := store.UpsertUserVerification(123, 11, "alice_new", StatusFailed); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
 
-	row := store.db.QueryRow("SELECT username, status FROM user_verifications WHERE user_id = ?", 123)
+	row := store.db.QueryRow("SELECT username, status FROM user_verifications WHERE user_id = ? AND chat_id = ?", 123, 10)
 	var username string
 	var status VerificationStatus
 	if err := row.Scan(&username, &status); err != nil {
@@ -42,6 +47,10 @@ func TestUpsertUserVerification(t *testing.T) {
 	if status != StatusSuccess {
 		t.Fatalf("expected status %s, got %s", StatusSuccess, status)
 	}
+	all, err := store.ListUserVerifications(123)
+	if err != nil || len(all) != 2 || all[0].ChatID != 10 || all[1].Status != StatusFailed {
+		t.Fatalf("unexpected statuses %+v (err=%v)", all, err)
+	}
 }
 
 func TestGroupConfigDefaultsAndUpsert(t *testing.T) {
@@ -51,7 +60,7 @@ func TestGroupConfigDefaultsAndUpsert(t *testing.T) {
 	if err != nil {
 		t.Fatalf("get default config failed: %v", err)
 	}
-	if cfg.ChatID != 1000 || cfg.RequireFollowupMessage {
+	if cfg.ChatID != 1000 || cfg.RequireFollowupMessage || !cfg.ShareVerification || cfg.ChallengeProvider != "" || cfg.VerifyMode != "webapp" {
 		t.Fatalf("unexpected default config: %+v", cfg)
 	}
 	if cfg.VerificationTimeout() != 6*time.Minute {
@@ -70,6 +79,10 @@ func TestGroupConfigDefaultsAndUpsert(t *testing.T) {
 		VerificationTimeoutSeconds: 30,
 		FailureBanCooldownSeconds:  45,
 		KickGracePeriodSeconds:     50,
+		ShareVerification:          false,
+		ChallengeProvider:          "hcaptcha",
+		VerifyMode:                 "inline",
+		Language:                   "en",
 	}
 	if err := store.UpsertGroupConfig(updated); err != nil {
 		t.Fatalf("upsert config failed: %v", err)
@@ -82,6 +95,12 @@ func TestGroupConfigDefaultsAndUpsert(t *testing.T) {
 	if !cfg.RequireFollowupMessage {
 		t.Fatalf("expected followup message requirement to be true")
 	}
+	if cfg.ShareVerification {
+		t.Fatalf("expected share verification to be false")
+	}
+	if cfg.ChallengeProvider != "hcaptcha" || cfg.VerifyMode != "inline" || cfg.Language != "en" {
+		t.Fatalf("unexpected provider, mode or language: %q %q %q", cfg.ChallengeProvider, cfg.VerifyMode, cfg.Language)
+	}
 	if cfg.VerificationTimeout() != 30*time.Second || cfg.BanCooldown() != 45*time.Second || cfg.KickGracePeriod() != 50*time.Second {
 		t.Fatalf("unexpected updated durations: vt=%v, ban=%v, kick=%v", cfg.VerificationTimeout(), cfg.BanCooldown(), cfg.KickGracePeriod())
 	}
@@ -90,10 +109,11 @@ func TestGroupConfigDefaultsAndUpsert(t *testing.T) {
 func TestPendingGroupLifecycle(t *testing.T) {
 	store := newTestStore(t)
 
-	if err := store.AddPendingGroup(1, 10); err != nil {
+	deadline := time.Now().Add(time.Minute)
+	if err := store.AddPendingGroup(1, 10, PendingSourceJoinRequest, deadline); err != nil {
 		t.Fatalf("add pending group failed: %v", err)
 	}
-	if err := store.AddPendingGroup(1, 11); err != nil {
+	if err := store.AddPendingGroup(1, 11, PendingSourceInviteLink, deadline); err != nil {
 		t.Fatalf("add second pending group failed: %v", err)
 	}
 
@@ -110,17 +130,325 @@ func TestPendingGroupLifecycle(t *testing.T) {
 		t.Fatalf("expected 2 pending groups, got %d", c)
 	}
 
-	if err := store.DeletePendingGroupsByUser(1); err != nil {
-		t.Fatalf("delete pending groups failed: %v", err)
+	if err := store.DeletePendingGroup(1, 10); err != nil {
+		t.Fatalf("delete single pending group failed: %v", err)
+	}
+	if c := count(); c != 1 {
+		t.Fatalf("expected 1 pending group after single delete, got %d", c)
+	}
+
+}
+
+func TestListPendingVerifications(t *testing.T) {
+	store := newTestStore(t)
+
+	deadline := time.Now().Add(5 * time.Minute).Truncate(time.Second)
+	if err := store.UpsertUserVerification(1, 10, "alice", StatusVerifying); err != nil {
+		t.Fatalf("upsert user failed: %v", err)
+	}
+	if err := store.UpsertUserVerification(2, 11, "bob", StatusVerifying); err != nil {
+		t.Fatalf("upsert user failed: %v", err)
+	}
+	if err := store.UpsertUserVerification(2, 12, "bob_other", StatusSuccess); err != nil {
+		t.Fatalf("upsert user failed: %v", err)
+	}
+	if err := store.AddPendingGroup(1, 10, PendingSourceInviteLink, deadline); err != nil {
+		t.Fatalf("add pending group failed: %v", err)
+	}
+	// 用户2在其他群组已经验证成功，但本群的会话仍未结束
+	if err := store.AddPendingGroup(2, 11, PendingSourceJoinRequest, deadline); err != nil {
+		t.Fatalf("add pending group failed: %v", err)
+	}
+
+	pending, err := store.ListPendingVerifications()
+	if err != nil {
+		t.Fatalf("list pending failed: %v", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("expected every pending session to be listed, got %+v", pending)
+	}
+	if pending[1].UserID != 2 || pending[1].ChatID != 11 || pending[1].Username != "bob" {
+		t.Fatalf("unexpected second pending record: %+v", pending[1])
+	}
+	p := pending[0]
+	if p.UserID != 1 || p.ChatID != 10 || p.Username != "alice" || p.Source != PendingSourceInviteLink {
+		t.Fatalf("unexpected pending record: %+v", p)
 	}
-	if c := count(); c != 0 {
-		t.Fatalf("expected 0 pending groups after delete, got %d", c)
+	if !p.Deadline.Equal(deadline) {
+		t.Fatalf("expected deadline %v, got %v", deadline, p.Deadline)
+	}
+	if p.RequestedAt.IsZero() {
+		t.Fatal("expected requested_at to be populated")
+	}
+}
+
+func TestInitTablesMigratesPendingGroups(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE pending_groups (
+                        user_id INTEGER NOT NULL,
+                        chat_id INTEGER NOT NULL,
+                        requested_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                        PRIMARY KEY (user_id, chat_id)
+                );`); err != nil {
+		t.Fatalf("create old table failed: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO pending_groups (user_id, chat_id) VALUES (1, 10);`); err != nil {
+		t.Fatalf("insert old row failed: %v", err)
+	}
+	_ = db.Close()
+
+	store, err := NewPersistentStore(dbPath)
+	if err != nil {
+		t.Fatalf("open store on old schema failed: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = store.db.Close()
+	})
+	pending, err := store.ListPendingVerifications()
+	if err != nil {
+		t.Fatalf("list pending failed: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Source != PendingSourceJoinRequest || !pending[0].Deadline.IsZero() {
+		t.Fatalf("unexpected migrated records: %+v", pending)
+	}
+}
+
+func TestInitTablesMigratesUserVerifications(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE user_verifications (
+                        user_id INTEGER PRIMARY KEY,
+                        username TEXT,
+                        status TEXT NOT NULL,
+                        updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+                );`,
+		`CREATE TABLE pending_groups (
+                        user_id INTEGER NOT NULL,
+                        chat_id INTEGER NOT NULL,
+                        requested_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                        PRIMARY KEY (user_id, chat_id)
+                );`,
+		`INSERT INTO user_verifications (user_id, username, status) VALUES (1, 'alice', 'verifying'), (2, 'bob', 'success');`,
+		`INSERT INTO pending_groups (user_id, chat_id) VALUES (1, 10), (1, 11);`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("prepare old schema failed: %v", err)
+		}
+	}
+	_ = db.Close()
+
+	store, err := NewPersistentStore(dbPath)
+	if err != nil {
+		t.Fatalf("open store on old schema failed: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = store.db.Close()
+	})
+	alice, err := store.ListUserVerifications(1)
+	if err != nil || len(alice) != 2 || alice[0].ChatID != 10 || alice[1].ChatID != 11 || alice[1].Username != "alice" {
+		t.Fatalf("expected the old status to be copied to each pending group, got %+v (err=%v)", alice, err)
+	}
+	bob, err := store.ListUserVerifications(2)
+	if err != nil || len(bob) != 1 || bob[0].ChatID != 0 || bob[0].Status != StatusSuccess {
+		t.Fatalf("expected users without pending groups to be kept, got %+v (err=%v)", bob, err)
+	}
+	if err := store.UpsertUserVerification(1, 12, "alice", StatusVerifying); err != nil {
+		t.Fatalf("upsert on migrated table failed: %v", err)
+	}
+}
+
+func TestJoinCooldown(t *testing.T) {
+	store := newTestStore(t)
+
+	until, err := store.GetJoinCooldown(1, 10)
+	if err != nil {
+		t.Fatalf("get cooldown failed: %v", err)
+	}
+	if !until.IsZero() {
+		t.Fatalf("expected no cooldown, got %v", until)
+	}
+
+	expected := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	if err := store.SetJoinCooldown(1, 10, expected); err != nil {
+		t.Fatalf("set cooldown failed: %v", err)
+	}
+	until, err = store.GetJoinCooldown(1, 10)
+	if err != nil {
+		t.Fatalf("get cooldown failed: %v", err)
+	}
+	if !until.Equal(expected) {
+		t.Fatalf("expected cooldown until %v, got %v", expected, until)
+	}
+	if other, err := store.GetJoinCooldown(1, 11); err != nil || !other.IsZero() {
+		t.Fatalf("expected cooldown to be scoped to chat, got %v (err=%v)", other, err)
+	}
+
+	if err := store.SetJoinCooldown(1, 10, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("overwrite cooldown failed: %v", err)
+	}
+	until, err = store.GetJoinCooldown(1, 10)
+	if err != nil {
+		t.Fatalf("get cooldown failed: %v", err)
+	}
+	if !until.IsZero() {
+		t.Fatalf("expected expired cooldown to be ignored, got %v", until)
+	}
+}
+
+func TestGroupTemplates(t *testing.T) {
+	store := newTestStore(t)
+
+	if _, ok, err := store.GetGroupTemplate(10, "welcome"); err != nil || ok {
+		t.Fatalf("expected no template, got ok=%v err=%v", ok, err)
+	}
+	if err := store.SetGroupTemplate(10, "welcome", "hi {{.Mention}}"); err != nil {
+		t.Fatalf("set template failed: %v", err)
+	}
+	if err := store.SetGroupTemplate(10, "welcome", "hello {{.Mention}}"); err != nil {
+		t.Fatalf("overwrite template failed: %v", err)
+	}
+	if err := store.SetGroupTemplate(10, "goodbye", "bye"); err != nil {
+		t.Fatalf("set template failed: %v", err)
+	}
+	text, ok, err := store.GetGroupTemplate(10, "welcome")
+	if err != nil || !ok || text != "hello {{.Mention}}" {
+		t.Fatalf("unexpected template %q (ok=%v err=%v)", text, ok, err)
+	}
+	if _, ok, _ := store.GetGroupTemplate(11, "welcome"); ok {
+		t.Fatal("expected template to be scoped to chat")
+	}
+	all, err := store.ListGroupTemplates(10)
+	if err != nil || len(all) != 2 || all["goodbye"] != "bye" {
+		t.Fatalf("unexpected templates %v (err=%v)", all, err)
+	}
+
+	if err := store.DeleteGroupTemplate(10, "welcome"); err != nil {
+		t.Fatalf("delete template failed: %v", err)
+	}
+	if _, ok, err := store.GetGroupTemplate(10, "welcome"); err != nil || ok {
+		t.Fatalf("expected template to be deleted, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestVerificationEvents(t *testing.T) {
+	store := newTestStore(t)
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	events := []VerificationEvent{
+		{UserID: 1, ChatID: 10, OldStatus: "", NewStatus: StatusVerifying, Trigger: TriggerJoinRequest, CreatedAt: base},
+		{UserID: 1, ChatID: 10, OldStatus: StatusVerifying, NewStatus: StatusFailed, Trigger: providerTurnstile,
+			ErrorCodes: []string{"invalid-input-response", "timeout-or-duplicate"}, ClientIP: "203.0.113.7", CreatedAt: base.Add(time.Minute)},
+		{UserID: 1, ChatID: 11, OldStatus: StatusVerifying, NewStatus: StatusSuccess, Trigger: TriggerInline, CreatedAt: base.Add(2 * time.Minute)},
+		{UserID: 2, ChatID: 10, OldStatus: StatusVerifying, NewStatus: StatusFailed, Trigger: TriggerTimeout, CreatedAt: base.Add(3 * time.Minute)},
+	}
+	for _, e := range events {
+		if err := store.AddVerificationEvent(e); err != nil {
+			t.Fatalf("add event failed: %v", err)
+		}
+	}
+
+	all, err := store.QueryVerificationEvents(VerificationEventFilter{})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(all) != 4 || all[0].UserID != 2 || all[3].Trigger != TriggerJoinRequest {
+		t.Fatalf("expected all events newest first, got %+v", all)
+	}
+
+	byUser, err := store.QueryVerificationEvents(VerificationEventFilter{UserID: 1, ChatID: 10})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(byUser) != 2 {
+		t.Fatalf("expected 2 events for user 1 in chat 10, got %d", len(byUser))
+	}
+	failed := byUser[0]
+	if failed.NewStatus != StatusFailed || failed.OldStatus != StatusVerifying || failed.ClientIP != "203.0.113.7" {
+		t.Fatalf("unexpected event: %+v", failed)
+	}
+	if len(failed.ErrorCodes) != 2 || failed.ErrorCodes[1] != "timeout-or-duplicate" {
+		t.Fatalf("expected error codes to round trip, got %v", failed.ErrorCodes)
+	}
+	if !failed.CreatedAt.Equal(base.Add(time.Minute)) {
+		t.Fatalf("expected created_at %v, got %v", base.Add(time.Minute), failed.CreatedAt)
+	}
+	if byUser[1].ErrorCodes != nil {
+		t.Fatalf("expected no error codes, got %v", byUser[1].ErrorCodes)
+	}
+
+	ranged, err := store.QueryVerificationEvents(VerificationEventFilter{
+		ChatID: 10,
+		Since:  base.Add(time.Minute),
+		Until:  base.Add(3 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(ranged) != 1 || ranged[0].NewStatus != StatusFailed || ranged[0].UserID != 1 {
+		t.Fatalf("expected only the turnstile failure in range, got %+v", ranged)
+	}
+
+	limited, err := store.QueryVerificationEvents(VerificationEventFilter{Limit: 1})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(limited) != 1 || limited[0].Trigger != TriggerTimeout {
+		t.Fatalf("expected the newest event only, got %+v", limited)
+	}
+}
+
+func TestListGroupConfigsAndStats(t *testing.T) {
+	store := newTestStore(t)
+
+	if _, err := store.GetOrCreateGroupConfig(20); err != nil {
+		t.Fatalf("create config failed: %v", err)
+	}
+	cfg := DefaultGroupConfig(10)
+	cfg.VerifyMode = verifyModeInline
+	if err := store.UpsertGroupConfig(cfg); err != nil {
+		t.Fatalf("upsert config failed: %v", err)
+	}
+	configs, err := store.ListGroupConfigs()
+	if err != nil {
+		t.Fatalf("list configs failed: %v", err)
+	}
+	if len(configs) != 2 || configs[0].ChatID != 10 || configs[0].VerifyMode != verifyModeInline || configs[1].ChatID != 20 {
+		t.Fatalf("unexpected configs: %+v", configs)
+	}
+
+	now := time.Now()
+	events := []VerificationEvent{
+		{UserID: 1, ChatID: 10, OldStatus: "", NewStatus: StatusVerifying, Trigger: TriggerJoinRequest, CreatedAt: now},
+		{UserID: 1, ChatID: 10, OldStatus: StatusVerifying, NewStatus: StatusSuccess, Trigger: providerTurnstile, CreatedAt: now},
+		{UserID: 2, ChatID: 10, OldStatus: StatusVerifying, NewStatus: StatusFailed, Trigger: TriggerTimeout, CreatedAt: now},
+		{UserID: 3, ChatID: 10, OldStatus: "", NewStatus: StatusFailed, Trigger: TriggerCooldown, CreatedAt: now},
+		{UserID: 4, ChatID: 20, OldStatus: StatusVerifying, NewStatus: StatusSuccess, Trigger: TriggerInline, CreatedAt: now.Add(-48 * time.Hour)},
+	}
+	for _, e := range events {
+		if err := store.AddVerificationEvent(e); err != nil {
+			t.Fatalf("add event failed: %v", err)
+		}
+	}
+	stats, err := store.VerificationStats(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	if len(stats) != 1 || stats[0] != (GroupVerificationStats{ChatID: 10, Succeeded: 1, Failed: 2}) {
+		t.Fatalf("unexpected stats: %+v", stats)
 	}
 }
 
 func TestNilStoreErrors(t *testing.T) {
 	var store *PersistentStore
-	if err := store.UpsertUserVerification(1, "", StatusFailed); err == nil {
+	if err := store.UpsertUserVerification(1, 1, "", StatusFailed); err == nil {
 		t.Fatal("expected error on nil store for UpsertUserVerification")
 	}
 	if err := store.UpsertGroupConfig(GroupConfig{ChatID: 1}); err == nil {
@@ -129,11 +457,65 @@ func TestNilStoreErrors(t *testing.T) {
 	if _, err := store.GetOrCreateGroupConfig(1); err == nil {
 		t.Fatal("expected error on nil store for GetOrCreateGroupConfig")
 	}
-	if err := store.AddPendingGroup(1, 1); err == nil {
+	if err := store.AddPendingGroup(1, 1, PendingSourceJoinRequest, time.Now()); err == nil {
 		t.Fatal("expected error on nil store for AddPendingGroup")
 	}
-	if err := store.DeletePendingGroupsByUser(1); err == nil {
-		t.Fatal("expected error on nil store for DeletePendingGroupsByUser")
+	if _, err := store.ListPendingVerifications(); err == nil {
+		t.Fatal("expected error on nil store for ListPendingVerifications")
+	}
+	if err := store.DeletePendingGroup(1, 1); err == nil {
+		t.Fatal("expected error on nil store for DeletePendingGroup")
+	}
+	if err := store.SetJoinCooldown(1, 1, time.Now()); err == nil {
+		t.Fatal("expected error on nil store for SetJoinCooldown")
+	}
+	if _, err := store.GetJoinCooldown(1, 1); err == nil {
+		t.Fatal("expected error on nil store for GetJoinCooldown")
+	}
+	if err := store.SetPendingDeadline(1, 1, time.Now()); err == nil {
+		t.Fatal("expected error on nil store for SetPendingDeadline")
+	}
+	if err := store.Ping(context.Background()); err == nil {
+		t.Fatal("expected error on nil store for Ping")
+	}
+	if err := store.Close(); err == nil {
+		t.Fatal("expected error on nil store for Close")
+	}
+	if _, err := store.MarkTokenUsed("kind", "token", time.Now()); err == nil {
+		t.Fatal("expected error on nil store for MarkTokenUsed")
+	}
+	if err := store.UnmarkTokenUsed("kind", "token"); err == nil {
+		t.Fatal("expected error on nil store for UnmarkTokenUsed")
+	}
+	if err := store.SetGroupTemplate(1, "welcome", ""); err == nil {
+		t.Fatal("expected error on nil store for SetGroupTemplate")
+	}
+	if _, _, err := store.GetGroupTemplate(1, "welcome"); err == nil {
+		t.Fatal("expected error on nil store for GetGroupTemplate")
+	}
+	if _, err := store.ListGroupTemplates(1); err == nil {
+		t.Fatal("expected error on nil store for ListGroupTemplates")
+	}
+	if err := store.DeleteGroupTemplate(1, "welcome"); err == nil {
+		t.Fatal("expected error on nil store for DeleteGroupTemplate")
+	}
+	if _, err := store.ListUserVerifications(1); err == nil {
+		t.Fatal("expected error on nil store for ListUserVerifications")
+	}
+	if err := store.ResetUserVerification(1); err == nil {
+		t.Fatal("expected error on nil store for ResetUserVerification")
+	}
+	if _, err := store.ListGroupConfigs(); err == nil {
+		t.Fatal("expected error on nil store for ListGroupConfigs")
+	}
+	if _, err := store.VerificationStats(time.Now()); err == nil {
+		t.Fatal("expected error on nil store for VerificationStats")
+	}
+	if err := store.AddVerificationEvent(VerificationEvent{UserID: 1, ChatID: 1}); err == nil {
+		t.Fatal("expected error on nil store for AddVerificationEvent")
+	}
+	if _, err := store.QueryVerificationEvents(VerificationEventFilter{}); err == nil {
+		t.Fatal("expected error on nil store for QueryVerificationEvents")
 	}
 }
 
@@ -143,7 +525,7 @@ func TestInitTablesIdempotent(t *testing.T) {
 		t.Fatalf("initTables not idempotent: %v", err)
 	}
 
-	if _, err := store.db.Exec("INSERT INTO user_verifications (user_id, username, status) VALUES (?,?,?)", 99, "foo", StatusVerifying); err != nil {
+	if _, err := store.db.Exec("INSERT INTO user_verifications (user_id, chat_id, username, status) VALUES (?,?,?,?)", 99, 10, "foo", StatusVerifying); err != nil {
 		t.Fatalf("insert failed after re-init: %v", err)
 	}
 	if err := store.initTables(); err != nil {